@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Actions applied to source files by --after once they have been converted.
+const (
+	afterKeep   = "keep"
+	afterDelete = "delete"
+	afterMove   = "move"
+)
+
+// afterAction is the parsed value of --after.
+type afterAction struct {
+	Kind string // afterKeep, afterDelete or afterMove.
+	Dir  string // Destination directory for afterMove.
+}
+
+// parseAfterAction parses an --after value: "keep", "delete" or "move:<dir>".
+// An empty value means keep.
+func parseAfterAction(s string) (afterAction, error) {
+	switch {
+	case s == "" || s == afterKeep:
+		return afterAction{Kind: afterKeep}, nil
+	case s == afterDelete:
+		return afterAction{Kind: afterDelete}, nil
+	case strings.HasPrefix(s, afterMove+":"):
+		dir := strings.TrimPrefix(s, afterMove+":")
+		if dir == "" {
+			return afterAction{}, errors.New("move needs a destination directory, e.g. move:/path/to/originals")
+		}
+		return afterAction{Kind: afterMove, Dir: dir}, nil
+	}
+	return afterAction{}, fmt.Errorf("unknown action %q, expected keep, delete or move:<dir>", s)
+}
+
+// destination returns where afterMove puts fPath, a file found under
+// inputPath. The path relative to inputPath is preserved so that files with
+// the same name in different directories do not collide.
+func (a afterAction) destination(inputPath, fPath string) string {
+	rel, err := filepath.Rel(inputPath, fPath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(fPath)
+	}
+	return filepath.Join(a.Dir, rel)
+}
+
+// apply deletes or moves the source file fPath and reports the outcome to
+// events. It must only be called once every output of fPath has been
+// written and verified. If one of outputs is fPath itself, the source has
+// been replaced by its output, which is left alone and reported as an error.
+func (a afterAction) apply(events eventSink, inputPath, fPath string, outputs []string) {
+	e := event{Path: fPath, Action: a.Kind}
+	if a.Kind != afterKeep && isOutput(fPath, outputs) {
+		e.Err = errors.New("the source is also an output")
+		e.Message = fmt.Sprintf("Not applying --after %s to %s, which is also one of its outputs", a.Kind, fPath)
+		events.OnError(e)
+		return
+	}
+	switch a.Kind {
+	case afterDelete:
+		if err := os.Remove(fPath); err != nil {
+			e.Err, e.Message = err, fmt.Sprintf("Failed to delete original %s: %v", fPath, err)
+			events.OnError(e)
+			return
+		}
+		e.Message = fmt.Sprintf("Deleted original %s", fPath)
+		events.OnInfo(e)
+	case afterMove:
+		dest := a.destination(inputPath, fPath)
+		e.Output = dest
+		if err := moveFile(fPath, dest); err != nil {
+			e.Err, e.Message = err, fmt.Sprintf("Failed to move original %s to %s: %v", fPath, dest, err)
+			events.OnError(e)
+			return
+		}
+		e.Message = fmt.Sprintf("Moved original %s to %s", fPath, dest)
+		events.OnInfo(e)
+	}
+}
+
+// plan reports the action apply would take for fPath to events, for
+// --dry-run.
+func (a afterAction) plan(events eventSink, inputPath, fPath string, outputs []string) {
+	if isOutput(fPath, outputs) {
+		return
+	}
+	switch a.Kind {
+	case afterDelete:
+		events.OnInfo(event{Path: fPath, Action: afterDelete, Planned: true,
+			Message: fmt.Sprintf("delete %s after a verified conversion", fPath)})
+	case afterMove:
+		dest := a.destination(inputPath, fPath)
+		events.OnInfo(event{Path: fPath, Output: dest, Action: afterMove, Planned: true,
+			Message: fmt.Sprintf("move %s to %s after a verified conversion", fPath, dest)})
+	}
+}
+
+// isOutput reports whether fPath is one of outputs.
+func isOutput(fPath string, outputs []string) bool {
+	for _, output := range outputs {
+		if samePath(output, fPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// moveFile moves src to dest, creating dest's directory. It refuses to
+// overwrite an existing file and falls back to copying when src and dest are
+// on different file systems.
+func moveFile(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("destination %s already exists", dest)
+	}
+	err := os.Rename(src, dest)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Remove(src)
+}
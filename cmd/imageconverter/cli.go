@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"imageconverter/internal/converter"
+)
+
+// version is the release version, set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// command is a subcommand of the CLI.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// commands lists the subcommands in the order they are shown in the usage.
+var commands = []command{
+	{"convert", "Convert images to WebP (or PNG/JPEG)", func(args []string) error { runConvert(args); return nil }},
+	{"info", "Show what the converter sees in image files", runInfoCommand},
+	{"verify", "Check that image files decode completely", runVerifyCommand},
+	{"serve", "Serve conversions over HTTP", runServe},
+	{"proxy", "Serve a directory, converting images to WebP for clients that accept it", runProxy},
+	{"version", "Print the version", runVersion},
+}
+
+// usage prints the top-level help.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(out, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+	fmt.Fprintf(out, "'%s --path PATH [flags]' is the same as '%s convert --path PATH [flags]'.\n", os.Args[0], os.Args[0])
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			// "help convert" is "convert -h".
+			args = []string{args[1], "-h"}
+			break
+		}
+		usage()
+		return
+	}
+	if strings.HasPrefix(args[0], "-") {
+		// Flags without a command, as accepted before there were commands.
+		runConvert(args)
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			if err := cmd.run(args[1:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Error: Unknown command %q.\n\n", args[0])
+	usage()
+	os.Exit(1)
+}
+
+// runVersion runs the "version" subcommand.
+func runVersion(args []string) error {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s version\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Prints the version, the Go version and the available WebP encoders.")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("version takes no arguments")
+	}
+
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				v += "-" + setting.Value[:12]
+			}
+		}
+	}
+	fmt.Printf("imageconverter %s (%s, %s/%s, WebP encoders: %s)\n", v, runtime.Version(), runtime.GOOS, runtime.GOARCH, strings.Join(converter.WebPEncoderNames(), ", "))
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+
+	"imageconverter/internal/converter"
+)
+
+// Kinds of event, named after the eventSink methods that receive them.
+const (
+	eventInfo       = "info"
+	eventDiscovered = "discovered"
+	eventConverted  = "converted"
+	eventSkipped    = "skipped"
+	eventError      = "error"
+)
+
+// event describes something that happened during a run, usually to a
+// single file.
+type event struct {
+	Path     string // The source file, if the event concerns one.
+	MIMEType string // The source file's sniffed MIME type, if known.
+	Output   string // The output file, if the event concerns one.
+	// Action is what was done, planned or attempted, e.g. "convert",
+	// "reencode", "verify", "delete", "move" or, for skips, "skip-exists",
+	// "skip-same-format", "skip-unsupported" or "skip-larger".
+	Action  string
+	Planned bool              // The action was only planned, by --dry-run.
+	Result  *converter.Result // The encoding result, for written outputs.
+	Err     error             // The failure, for errors.
+	// Message describes the event for people, without a level prefix.
+	Message string
+}
+
+// eventSink receives the events of a run as they happen.
+type eventSink interface {
+	// OnInfo receives notes about the run, such as the settings in effect,
+	// and the outcome of follow-up actions such as --verify and --after.
+	OnInfo(e event)
+	// OnDiscovered receives every file about to be processed.
+	OnDiscovered(e event)
+	// OnConverted receives every output written, or planned.
+	OnConverted(e event)
+	// OnSkipped receives every file or output left alone, and why.
+	OnSkipped(e event)
+	// OnError receives every failure that does not stop the run.
+	OnError(e event)
+}
+
+// eventLevel returns the level an event of the given kind is logged at:
+// discovered files are only logged for debugging, and planned actions have
+// a level of their own.
+func eventLevel(kind string, e event) slog.Level {
+	switch {
+	case kind == eventError:
+		return slog.LevelError
+	case kind == eventDiscovered:
+		return slog.LevelDebug
+	case e.Planned:
+		return levelPlan
+	}
+	return slog.LevelInfo
+}
+
+// logSink logs events as they happen.
+type logSink struct {
+	log *slog.Logger
+	// structured attaches the fields of events to their records. The text
+	// format leaves them out, since the messages already name them.
+	structured bool
+}
+
+func (s *logSink) OnInfo(e event)       { s.write(eventInfo, e) }
+func (s *logSink) OnDiscovered(e event) { s.write(eventDiscovered, e) }
+func (s *logSink) OnConverted(e event)  { s.write(eventConverted, e) }
+func (s *logSink) OnSkipped(e event)    { s.write(eventSkipped, e) }
+func (s *logSink) OnError(e event)      { s.write(eventError, e) }
+
+func (s *logSink) write(kind string, e event) {
+	var attrs []slog.Attr
+	if s.structured {
+		je := newJSONEvent(kind, e)
+		attrs = append(attrs, slog.String("event", je.Event))
+		for _, a := range []struct{ key, value string }{
+			{"action", je.Action}, {"path", je.Path}, {"mime_type", je.MIMEType}, {"output", je.Output}, {"error", je.Error},
+		} {
+			if a.value != "" {
+				attrs = append(attrs, slog.String(a.key, a.value))
+			}
+		}
+		if je.Planned {
+			attrs = append(attrs, slog.Bool("planned", true))
+		}
+		if e.Result != nil {
+			attrs = append(attrs, slog.Int64("input_size", je.InputSize), slog.Int64("output_size", je.OutputSize))
+		}
+	}
+	s.log.LogAttrs(context.Background(), eventLevel(kind, e), e.Message, attrs...)
+}
+
+// jsonEvent is the JSON form of an event.
+type jsonEvent struct {
+	Event      string `json:"event"`
+	Action     string `json:"action,omitempty"`
+	Path       string `json:"path,omitempty"`
+	MIMEType   string `json:"mime_type,omitempty"`
+	Output     string `json:"output,omitempty"`
+	Planned    bool   `json:"planned,omitempty"`
+	InputSize  int64  `json:"input_size,omitempty"`
+	OutputSize int64  `json:"output_size,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Message    string `json:"message"`
+}
+
+// jsonSink writes every event as a JSON object on its own line.
+type jsonSink struct {
+	enc *json.Encoder
+}
+
+// newJSONSink returns a jsonSink that writes to w.
+func newJSONSink(w io.Writer) *jsonSink {
+	return &jsonSink{enc: json.NewEncoder(w)}
+}
+
+func (s *jsonSink) OnInfo(e event)       { s.write(eventInfo, e) }
+func (s *jsonSink) OnDiscovered(e event) { s.write(eventDiscovered, e) }
+func (s *jsonSink) OnConverted(e event)  { s.write(eventConverted, e) }
+func (s *jsonSink) OnSkipped(e event)    { s.write(eventSkipped, e) }
+func (s *jsonSink) OnError(e event)      { s.write(eventError, e) }
+
+func (s *jsonSink) write(kind string, e event) {
+	s.enc.Encode(newJSONEvent(kind, e))
+}
+
+// newJSONEvent returns the JSON form of an event of the given kind.
+func newJSONEvent(kind string, e event) jsonEvent {
+	je := jsonEvent{
+		Event:    kind,
+		Action:   e.Action,
+		Path:     e.Path,
+		MIMEType: e.MIMEType,
+		Output:   e.Output,
+		Planned:  e.Planned,
+		Message:  e.Message,
+	}
+	if e.Result != nil {
+		je.InputSize, je.OutputSize = e.Result.InputSize, e.Result.OutputSize
+	}
+	if e.Err != nil {
+		je.Error = e.Err.Error()
+	}
+	return je
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"imageconverter/internal/imageinfo"
+)
+
+// runInfoCommand runs the "info" subcommand.
+func runInfoCommand(args []string) error {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print a JSON array with one object per file")
+	logging := addLogFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s info [flags] FILE...\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Prints what the converter sees in each file: the detected MIME type, dimensions, colour model, transparency, frame count and, for WebP files, the RIFF chunk layout.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no files given")
+	}
+
+	log, err := logging.logger()
+	if err != nil {
+		return err
+	}
+
+	if !*asJSON {
+		// Each file is printed as soon as it has been inspected.
+		return inspectFiles(flags.Args(), log, func(info imageinfo.Info) {
+			fmt.Println(strings.Join(describeInfo(info), "\n"))
+		})
+	}
+	infos := []imageinfo.Info{}
+	err = inspectFiles(flags.Args(), log, func(info imageinfo.Info) { infos = append(infos, info) })
+	out, jsonErr := json.MarshalIndent(infos, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	fmt.Println(string(out))
+	return err
+}
+
+// inspectFiles inspects each of the files at paths, passing those it can
+// read to each and logging the others. It returns an error if any of them
+// could not be read.
+func inspectFiles(paths []string, log *slog.Logger, each func(imageinfo.Info)) error {
+	var failed []string
+	for _, fPath := range paths {
+		info, err := imageinfo.Inspect(fPath)
+		if err != nil {
+			log.Error(fmt.Sprintf("Error reading file %s: %v", fPath, err))
+			failed = append(failed, fPath)
+			continue
+		}
+		each(info)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not read %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// describeInfo formats info as indented lines for the terminal.
+func describeInfo(info imageinfo.Info) []string {
+	lines := []string{info.Path, "  MIME type:    " + info.MIMEType}
+	if info.Format != "" {
+		alpha := "no"
+		if info.Alpha {
+			alpha = "yes"
+		} else if info.Error != "" {
+			alpha = "unknown" // The pixels could not be decoded.
+		}
+		lines = append(lines,
+			"  Format:       "+info.Format,
+			fmt.Sprintf("  Dimensions:   %dx%d", info.Width, info.Height),
+		)
+		if info.ColorModel != "" {
+			lines = append(lines, "  Colour model: "+info.ColorModel)
+		}
+		lines = append(lines,
+			"  Alpha:        "+alpha,
+			fmt.Sprintf("  Frames:       %d", info.Frames),
+		)
+	}
+	if len(info.Chunks) > 0 {
+		lines = append(lines, "  RIFF chunks:")
+		lines = appendChunks(lines, info.Chunks, "    ")
+	}
+	if info.Error != "" {
+		lines = append(lines, "  Error:        "+info.Error)
+	}
+	return lines
+}
+
+// appendChunks appends one line per chunk, and per nested frame chunk, to lines.
+func appendChunks(lines []string, chunks []imageinfo.Chunk, indent string) []string {
+	for _, c := range chunks {
+		line := fmt.Sprintf("%s%-4s at offset %d, %d bytes", indent, c.ID, c.Offset, c.Size)
+		if c.Details != "" {
+			line += ": " + c.Details
+		}
+		lines = appendChunks(append(lines, line), c.Chunks, indent+"  ")
+	}
+	return lines
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Values of --log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// levelPlan is the level of the actions --dry-run plans. It sits between
+// info and warn so that it is shown whenever info is.
+const levelPlan = slog.LevelInfo + 1
+
+// levelName names l as it is printed: "PLAN" for levelPlan, otherwise the
+// standard name such as "INFO".
+func levelName(l slog.Level) string {
+	if l == levelPlan {
+		return "PLAN"
+	}
+	return l.String()
+}
+
+// parseLogLevel parses a --log-level value.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch s {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown level %q, expected debug, info, warn or error", s)
+}
+
+// logFlags are the --log-level and --log-format flags of the commands other
+// than convert.
+type logFlags struct {
+	level, format *string
+}
+
+// addLogFlags registers --log-level and --log-format on flags.
+func addLogFlags(flags *flag.FlagSet) logFlags {
+	return logFlags{
+		level:  flags.String("log-level", "info", "Lowest level to log: 'debug', 'info', 'warn' or 'error'"),
+		format: flags.String("log-format", logFormatText, "Log format: 'text' ('LEVEL: message' lines) or 'json' (one JSON object per record)"),
+	}
+}
+
+// logger returns a logger for the flag values that writes errors to stderr
+// and everything else to stdout, and makes it the default logger so that
+// the internal packages log through it too.
+func (f logFlags) logger() (*slog.Logger, error) {
+	level, err := parseLogLevel(*f.level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --log-level: %w", err)
+	}
+	if *f.format != logFormatText && *f.format != logFormatJSON {
+		return nil, fmt.Errorf("invalid --log-format %q, expected 'text' or 'json'", *f.format)
+	}
+	log := newLogger(level, *f.format, os.Stdout, os.Stderr)
+	slog.SetDefault(log)
+	return log, nil
+}
+
+// newLogger returns a logger that writes records of at least level in the
+// given format, errors to errOut and everything else to out.
+func newLogger(level slog.Level, format string, out, errOut io.Writer) *slog.Logger {
+	if format == logFormatJSON {
+		opts := &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if l, ok := a.Value.Any().(slog.Level); ok && a.Key == slog.LevelKey && len(groups) == 0 {
+					a.Value = slog.StringValue(levelName(l))
+				}
+				return a
+			},
+		}
+		return slog.New(&splitHandler{out: slog.NewJSONHandler(out, opts), errOut: slog.NewJSONHandler(errOut, opts)})
+	}
+	var mu sync.Mutex // out and errOut are usually the same terminal.
+	return slog.New(&splitHandler{
+		out:    &lineHandler{w: out, level: level, mu: &mu},
+		errOut: &lineHandler{w: errOut, level: level, mu: &mu},
+	})
+}
+
+// splitHandler sends errors to one handler and everything else to another.
+type splitHandler struct {
+	out, errOut slog.Handler
+}
+
+func (h *splitHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	if l >= slog.LevelError {
+		return h.errOut.Enabled(ctx, l)
+	}
+	return h.out.Enabled(ctx, l)
+}
+
+func (h *splitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		return h.errOut.Handle(ctx, r)
+	}
+	return h.out.Handle(ctx, r)
+}
+
+func (h *splitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &splitHandler{out: h.out.WithAttrs(attrs), errOut: h.errOut.WithAttrs(attrs)}
+}
+
+func (h *splitHandler) WithGroup(name string) slog.Handler {
+	return &splitHandler{out: h.out.WithGroup(name), errOut: h.errOut.WithGroup(name)}
+}
+
+// lineHandler writes each record as a line such as
+// "INFO: Converted a.png size=1024", the format the tool has always used.
+type lineHandler struct {
+	w      io.Writer
+	level  slog.Leveler
+	mu     *sync.Mutex
+	prefix string // Key prefix of the open groups, e.g. "group.".
+	attrs  string // Preformatted attributes added with WithAttrs.
+}
+
+func (h *lineHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(levelName(r.Level) + ": " + r.Message + h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteString("\n")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		appendAttr(&b, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs += b.String()
+	return &h2
+}
+
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// appendAttr appends a as " key=value" to b, flattening groups into dotted
+// keys and quoting values that contain spaces.
+func appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, g := range a.Value.Group() {
+			appendAttr(b, prefix, g)
+		}
+		return
+	}
+	v := a.Value.String()
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		v = strconv.Quote(v)
+	}
+	b.WriteString(" " + prefix + a.Key + "=" + v)
+}
+
+// progressWriter writes to w with the progress bar hidden, so that log lines
+// do not run into it.
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	pw.p.hide()
+	defer pw.p.show()
+	return pw.w.Write(b)
+}
@@ -3,128 +3,603 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image/color"
 	"os"
 	"io"
-	"net/http"
+	"log/slog"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"errors"
+	"imageconverter/internal/config"
 	"imageconverter/internal/converter"
 	"imageconverter/internal/filesystem"
+	"imageconverter/internal/imageinfo"
+	"imageconverter/internal/watcher"
 
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// TIFF page handling modes for appOptions.TIFFPages.
+const (
+	tiffPagesFirst = "first" // Convert only the first page of multi-page TIFFs.
+	tiffPagesAll   = "all"   // Convert every page to its own output file.
 )
 
+// appOptions holds the settings runApp applies to every processed file.
+type appOptions struct {
+	Force     bool
+	TIFFPages string
+	// ReencodeWebP recompresses existing WebP inputs in place, keeping the
+	// result only when it is smaller than the original.
+	ReencodeWebP bool
+	// Convert holds the encoding options passed to the converter package.
+	Convert converter.Options
+	// Config holds per-glob settings from a configuration file, or nil.
+	// Overrides holds the settings given explicitly on the command line,
+	// which take precedence over Config.
+	Config    *config.Config
+	Overrides config.Settings
+	// Root is the directory --after move preserves paths relative to. It
+	// defaults to the input path; watch mode sets it to the watched tree.
+	Root string
+	// OnOutput, if set, is called with the source and the path of every
+	// file written. Re-encoded WebP files are their own output.
+	OnOutput func(source, output string)
+	// OnJobs, if set, is called with every file of the batch once its
+	// outputs are resolved and checked for collisions, before any is run.
+	OnJobs func(jobs []job)
+	// NameTemplate names the output files.
+	NameTemplate nameTemplate
+	// DryRun reports the planned action for every file without decoding or
+	// writing anything.
+	DryRun bool
+	// Verify decodes every converted output and checks its dimensions
+	// against the source; outputs that fail are removed. VerifyPSNR, if
+	// positive, also requires the output's PSNR against the source to reach
+	// that many decibels.
+	Verify     bool
+	VerifyPSNR float64
+	// Events receives everything the run does as it happens. It must be set.
+	Events eventSink
+	// Progress, if set, is told about every file processed. It is not used
+	// in dry runs.
+	Progress *progress
+	// After is applied to each source file once all of its outputs have
+	// been written and verified decodable in this run.
+	After afterAction
+}
+
+// savingsFlag is the value of --only-if-smaller. It can be given without a
+// value, like a boolean flag, or with a minimum savings percentage such as
+// --only-if-smaller=10 or --only-if-smaller=10%.
+type savingsFlag struct {
+	set     bool
+	percent float64
+}
+
+func (f *savingsFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return strconv.FormatFloat(f.percent, 'g', -1, 64) + "%"
+}
+
+func (f *savingsFlag) Set(s string) error {
+	if enabled, err := strconv.ParseBool(s); err == nil {
+		f.set, f.percent = enabled, 0
+		return nil
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || percent < 0 || percent >= 100 {
+		return fmt.Errorf("expected a percentage from 0 to 100, got %q", s)
+	}
+	f.set, f.percent = true, percent
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value.
+func (f *savingsFlag) IsBoolFlag() bool { return true }
+
 // runApp encapsulates the core application logic.
-// It returns a list of messages detailing operations and an error for critical issues.
-func runApp(inputPath string, forceOverwrite bool) ([]string, error) {
-	var messages []string
+// It reports what it does to opts.Events as it goes and returns an error for critical issues.
+func runApp(inputPath string, opts appOptions) error {
+	events := opts.Events
+	forceOverwrite := opts.Force
 
 	// Check if path exists
 	if _, err := os.Stat(inputPath); os.IsNotExist(err) {
-		return messages, fmt.Errorf("path '%s' does not exist", inputPath)
+		return fmt.Errorf("path '%s' does not exist", inputPath)
 	} else if err != nil {
-		return messages, fmt.Errorf("error checking path '%s': %w", inputPath, err)
+		return fmt.Errorf("error checking path '%s': %w", inputPath, err)
 	}
 
-	messages = append(messages, fmt.Sprintf("INFO: Input path: %s", inputPath))
-	messages = append(messages, fmt.Sprintf("INFO: Force overwrite: %t", forceOverwrite))
+	encoder, err := converter.EncoderFor(opts.Convert.Format)
+	if err != nil {
+		return err
+	}
+
+	events.OnInfo(event{Message: fmt.Sprintf("Input path: %s", inputPath)})
+	events.OnInfo(event{Message: fmt.Sprintf("Force overwrite: %t", forceOverwrite)})
+	events.OnInfo(event{Message: fmt.Sprintf("Output format: %s", encoder.MIMEType())})
+	if opts.Config != nil {
+		events.OnInfo(event{Message: fmt.Sprintf("Config file: %s (%d rules)", filepath.Join(opts.Config.Dir, config.FileName), len(opts.Config.Rules))})
+	}
 
 	files, err := filesystem.FindFiles(inputPath)
 	if err != nil {
-		return messages, fmt.Errorf("error finding files: %w", err)
+		return fmt.Errorf("error finding files: %w", err)
 	}
 
 	if len(files) == 0 {
-		messages = append(messages, "INFO: No processable files found.")
-		return messages, nil
+		events.OnInfo(event{Message: "No processable files found."})
+		return nil
 	}
 
-	messages = append(messages, "INFO: Processing files...")
+	if opts.DryRun {
+		events.OnInfo(event{Message: "Dry run, no files will be decoded or written."})
+	}
+	events.OnInfo(event{Message: "Processing files..."})
+
+	root := inputPath
+	if opts.Root != "" {
+		root = opts.Root
+	}
+
+	// Sniff every file and resolve its outputs first, so that output name
+	// collisions across the batch are caught before anything is written.
+	var jobs []job
 	for _, fPath := range files {
-		file, openErr := os.Open(fPath)
-		if openErr != nil {
-			messages = append(messages, fmt.Sprintf("ERROR: Error opening file %s: %v. Skipping.", fPath, openErr))
-			continue
+		if j, ok := newJob(fPath, encoder, opts); ok {
+			jobs = append(jobs, j)
 		}
+	}
+	detectCollisions(jobs, encoder, opts.Force)
+	if opts.OnJobs != nil {
+		opts.OnJobs(jobs)
+	}
 
-		buffer := make([]byte, 512)
-		n, readErr := file.Read(buffer)
-		if readErr != nil && readErr != io.EOF {
-			messages = append(messages, fmt.Sprintf("ERROR: Error reading file %s for content type detection: %v. Skipping.", fPath, readErr))
-			file.Close()
-			continue
+	showProgress := opts.Progress != nil && !opts.DryRun
+	if showProgress {
+		opts.Progress.begin(len(jobs))
+	}
+	for _, j := range jobs {
+		saved := runJob(j, encoder, root, opts)
+		if showProgress {
+			opts.Progress.advance(saved)
 		}
-		mimeType := http.DetectContentType(buffer[:n])
+	}
+	if showProgress {
+		events.OnInfo(event{Message: opts.Progress.finish()})
+	}
+	return nil
+}
 
-		_, seekErr := file.Seek(0, 0)
-		if seekErr != nil {
-			messages = append(messages, fmt.Sprintf("ERROR: Error seeking in file %s: %v. Skipping.", fPath, seekErr))
-			file.Close()
-			continue
+// newJob sniffs fPath and resolves its outputs. If the file cannot be
+// read, it reports the error to opts.Events and returns false.
+func newJob(fPath string, encoder converter.Encoder, opts appOptions) (job, bool) {
+	mimeType, err := sniffFile(fPath)
+	if err != nil {
+		opts.Events.OnError(event{Path: fPath, Err: err, Message: fmt.Sprintf("Error %v. Skipping.", err)})
+		return job{}, false
+	}
+	j := job{path: fPath, mimeType: mimeType, convOpts: opts.convertOptions(fPath)}
+	if isConvertible(mimeType, encoder) {
+		j.outputs, j.err = resolveOutputs(fPath, mimeType, encoder, opts.TIFFPages, opts.NameTemplate, j.convOpts)
+	}
+	return j, true
+}
+
+// runJob processes a single discovered file and reports the outcome to
+// opts.Events. It returns the number of bytes saved by the outputs it
+// wrote.
+func runJob(j job, encoder converter.Encoder, root string, opts appOptions) int64 {
+	events := opts.Events
+	var saved int64
+	fPath, mimeType := j.path, j.mimeType
+	events.OnDiscovered(event{Path: fPath, MIMEType: mimeType, Message: fmt.Sprintf("File: %s, Detected MIME type: %s", fPath, mimeType)})
+
+	if mimeType == "image/webp" && mimeType == encoder.MIMEType() {
+		switch {
+		case opts.ReencodeWebP && opts.DryRun:
+			events.OnConverted(event{Path: fPath, MIMEType: mimeType, Output: fPath, Action: "reencode", Planned: true,
+				Message: fmt.Sprintf("reencode %s (replaced only if the result is smaller)", fPath)})
+		case opts.ReencodeWebP:
+			res := reencodeFile(events, fPath, j.convOpts)
+			if res.Written {
+				saved = res.InputSize - res.OutputSize
+			}
+			if opts.OnOutput != nil {
+				opts.OnOutput(fPath, fPath)
+			}
+		case opts.DryRun:
+			events.OnSkipped(event{Path: fPath, MIMEType: mimeType, Action: "skip-same-format", Planned: true,
+				Message: fmt.Sprintf("skip-same-format %s (already WebP; use --reencode-webp to recompress)", fPath)})
+		default:
+			events.OnSkipped(event{Path: fPath, MIMEType: mimeType, Action: "skip-same-format",
+				Message: fmt.Sprintf("Skipping file %s (detected MIME type: %s, already WebP; use --reencode-webp to recompress).", fPath, mimeType)})
+		}
+	} else if mimeType == encoder.MIMEType() {
+		if opts.DryRun {
+			events.OnSkipped(event{Path: fPath, MIMEType: mimeType, Action: "skip-same-format", Planned: true,
+				Message: fmt.Sprintf("skip-same-format %s (MIME: %s)", fPath, mimeType)})
+			return 0
+		}
+		events.OnSkipped(event{Path: fPath, MIMEType: mimeType, Action: "skip-same-format",
+			Message: fmt.Sprintf("Skipping file %s (detected MIME type: %s, already in the output format).", fPath, mimeType)})
+	} else if isConvertible(mimeType, encoder) {
+		if j.err != nil {
+			events.OnError(event{Path: fPath, MIMEType: mimeType, Action: "convert", Err: j.err,
+				Message: fmt.Sprintf("Failed to convert %s (MIME: %s): %v", fPath, mimeType, j.err)})
+			return 0
+		}
+		if opts.DryRun {
+			planConversion(events, root, fPath, mimeType, j.outputs, opts)
+			return 0
 		}
-		// It's important to close the file if we are done with it here,
-		// or ensure ConvertToWebP handles an already open file (currently it reopens).
-		// For simplicity, closing it here is fine since ConvertToWebP reopens.
-		file.Close()
+		allWritten := true
+		var inputSize, outputSize int64
+		for page, output := range j.outputs {
+			pageOpts := j.convOpts
+			pageOpts.Page = page
+			res, written := convertFile(events, fPath, output, mimeType, opts.Force, pageOpts, opts.Verify, opts.After.Kind != afterKeep, opts.VerifyPSNR)
+			if written {
+				// Every page is converted from the same input file.
+				inputSize = res.InputSize
+				outputSize += res.OutputSize
+				if opts.OnOutput != nil {
+					opts.OnOutput(fPath, output)
+				}
+			}
+			allWritten = allWritten && written
+		}
+		saved = inputSize - outputSize
+		if allWritten {
+			opts.After.apply(events, root, fPath, j.outputs)
+		}
+	} else if opts.DryRun {
+		events.OnSkipped(event{Path: fPath, MIMEType: mimeType, Action: "skip-unsupported", Planned: true,
+			Message: fmt.Sprintf("skip-unsupported %s (MIME: %s)", fPath, mimeType)})
+	} else {
+		events.OnSkipped(event{Path: fPath, MIMEType: mimeType, Action: "skip-unsupported",
+			Message: fmt.Sprintf("Skipping file %s (detected MIME type: %s, not a supported image format).", fPath, mimeType)})
+	}
+	return saved
+}
 
-		messages = append(messages, fmt.Sprintf("INFO: File: %s, Detected MIME type: %s", fPath, mimeType))
+// job is a discovered file along with the outputs it will be converted to.
+type job struct {
+	path     string
+	mimeType string
+	convOpts converter.Options
+	outputs  []string // One per page; empty unless the file is converted.
+	err      error    // Set if the outputs could not be resolved or collide.
+}
+
+// sniffFile detects the MIME type of fPath from its first 512 bytes.
+func sniffFile(fPath string) (string, error) {
+	file, openErr := os.Open(fPath)
+	if openErr != nil {
+		return "", fmt.Errorf("opening file %s: %w", fPath, openErr)
+	}
+	defer file.Close()
 
-		isSupportedMimeType := false
-		switch mimeType {
-		case "image/jpeg", "image/png", "image/gif":
-			isSupportedMimeType = true
+	buffer := make([]byte, 512)
+	n, readErr := file.Read(buffer)
+	if readErr != nil && readErr != io.EOF {
+		return "", fmt.Errorf("reading file %s for content type detection: %w", fPath, readErr)
+	}
+	return imageinfo.DetectContentType(buffer[:n]), nil
+}
+
+// isConvertible reports whether files of mimeType are converted with encoder
+// rather than skipped or re-encoded.
+func isConvertible(mimeType string, encoder converter.Encoder) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/bmp", "image/tiff", "image/webp":
+		return mimeType != encoder.MIMEType()
+	}
+	return false
+}
+
+// resolveOutputs returns the output paths of fPath, one per converted page.
+func resolveOutputs(fPath, mimeType string, encoder converter.Encoder, tiffPages string, names nameTemplate, convOpts converter.Options) ([]string, error) {
+	pages := 1
+	if mimeType == "image/tiff" && tiffPages == tiffPagesAll {
+		count, err := converter.TIFFPageCount(fPath)
+		if err != nil {
+			return nil, err
 		}
+		pages = count
+	}
+	return names.outputs(fPath, pages, encoder, convOpts)
+}
 
-		if isSupportedMimeType {
-			baseName := strings.TrimSuffix(filepath.Base(fPath), filepath.Ext(fPath))
-			outputFilePath := filepath.Join(filepath.Dir(fPath), baseName+".webp")
+// convertOptions returns the conversion options for fPath: the command-line
+// options, overridden by the configuration file's settings for fPath, in
+// turn overridden by the options given explicitly on the command line.
+func (opts appOptions) convertOptions(fPath string) converter.Options {
+	convOpts := opts.Convert
+	if opts.Config != nil {
+		opts.Config.Resolve(fPath).Apply(&convOpts)
+		opts.Overrides.Apply(&convOpts)
+	}
+	return convOpts
+}
 
-			errConv := converter.ConvertToWebP(fPath, outputFilePath, forceOverwrite)
-			if errConv != nil {
-				if strings.Contains(errConv.Error(), "already exists, use --force to overwrite") {
-					// This specific error is more of a notice/skip condition if force is false.
-					messages = append(messages, fmt.Sprintf("INFO: Skipping conversion (file exists, based on content type): %s", outputFilePath))
-				} else {
-					messages = append(messages, fmt.Sprintf("ERROR: Failed to convert %s (MIME: %s): %v", fPath, mimeType, errConv))
+// detectCollisions marks jobs whose outputs would also be written by another
+// job in the batch. With force, it also marks jobs whose outputs would
+// overwrite another source of the batch that replaceable does not allow to
+// be overwritten, including sources that are skipped, such as a.png when
+// a.webp is converted back to PNG. Without force, existing files are never
+// overwritten.
+func detectCollisions(jobs []job, encoder converter.Encoder, force bool) {
+	sources := make(map[string]int)
+	writers := make(map[string][]int)
+	for i, j := range jobs {
+		sources[pathKey(j.path)] = i
+		for _, output := range j.outputs {
+			writers[pathKey(output)] = append(writers[pathKey(output)], i)
+		}
+	}
+	for i := range jobs {
+		j := &jobs[i]
+		if j.err != nil {
+			continue
+		}
+		for _, output := range j.outputs {
+			if other, ok := sources[pathKey(output)]; ok && other != i && force && !replaceable(jobs[other], encoder) {
+				j.err = fmt.Errorf("output %s would overwrite the source file %s; use --name-template to disambiguate", output, jobs[other].path)
+				break
+			}
+			if others := writers[pathKey(output)]; len(others) > 1 {
+				var names []string
+				for _, other := range others {
+					if other != i {
+						names = append(names, jobs[other].path)
+					}
 				}
-			} else {
-				messages = append(messages, fmt.Sprintf("INFO: Successfully converted %s (MIME: %s) to %s", fPath, mimeType, outputFilePath))
+				j.err = fmt.Errorf("output %s collides with the output of %s; use --name-template to disambiguate", output, strings.Join(names, ", "))
+				break
 			}
-		} else {
-			messages = append(messages, fmt.Sprintf("INFO: Skipping file %s (detected MIME type: %s, not a supported image format).", fPath, mimeType))
 		}
 	}
-	return messages, nil
 }
 
-func main() {
-	// Define flags
-	path := flag.String("path", "", "Input file or directory path (required)")
-	flag.StringVar(path, "p", "", "Input file or directory path (alias for -path)")
-	force := flag.Bool("force", false, "Overwrite existing files")
-	flag.BoolVar(force, "f", false, "Overwrite existing files (alias for -force)")
+// replaceable reports whether --force may overwrite the source of other
+// with an output of encoder. Only WebP files may be, as --force has always
+// promised, since next to another image they are usually the output of an
+// earlier run. Other sources, such as the a.png that a.webp was made from,
+// may be originals.
+func replaceable(other job, encoder converter.Encoder) bool {
+	return other.mimeType == "image/webp" && encoder.MIMEType() == "image/webp"
+}
 
-	flag.Parse()
+// pathKey returns the cleaned absolute form of path, under which paths that
+// name the same file compare equal.
+func pathKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
 
-	if *path == "" {
-		fmt.Fprintln(os.Stderr, "Error: Input path is required. Use --path or -p.")
-		flag.Usage()
-		os.Exit(1)
+// planConversion reports the actions a real run would take to convert fPath
+// to outputs, including the --after action, without touching any file.
+func planConversion(events eventSink, inputPath, fPath, mimeType string, outputs []string, opts appOptions) {
+	allWritten := true
+	for _, output := range outputs {
+		if _, err := os.Stat(output); err == nil && !opts.Force {
+			events.OnSkipped(event{Path: fPath, MIMEType: mimeType, Output: output, Action: "skip-exists", Planned: true,
+				Message: fmt.Sprintf("skip-exists %s (output %s exists, use --force to overwrite)", fPath, output)})
+			allWritten = false
+			continue
+		}
+		events.OnConverted(event{Path: fPath, MIMEType: mimeType, Output: output, Action: "convert", Planned: true,
+			Message: fmt.Sprintf("convert %s -> %s", fPath, output)})
+	}
+	if allWritten {
+		opts.After.plan(events, inputPath, fPath, outputs)
 	}
+}
+
+// convertFile converts a single input file and reports the outcome to
+// events. It returns the conversion result and reports whether the output
+// was written and passed its checks. With verify, the output is checked
+// with converter.Verify, and against minPSNR if it is positive, and removed
+// if it fails. Otherwise, with checkDecodable, it is only decoded, which
+// is done before a destructive --after acts on the source.
+func convertFile(events eventSink, fPath, outputFilePath, mimeType string, forceOverwrite bool, convOpts converter.Options, verify, checkDecodable bool, minPSNR float64) (converter.Result, bool) {
+	e := event{Path: fPath, MIMEType: mimeType, Output: outputFilePath}
+	res, errConv := converter.Convert(fPath, outputFilePath, forceOverwrite, convOpts)
+	if errConv == nil && !res.Written {
+		e.Action, e.Result = "skip-larger", &res
+		e.Message = fmt.Sprintf("Skipping output %s (%s)", outputFilePath, describeSavings(res, convOpts))
+		events.OnSkipped(e)
+		return res, false
+	}
+	if errConv != nil {
+		if strings.Contains(errConv.Error(), "already exists, use --force to overwrite") {
+			// This specific error is more of a notice/skip condition if force is false.
+			e.Action, e.Message = "skip-exists", fmt.Sprintf("Skipping conversion (file exists, based on content type): %s", outputFilePath)
+			events.OnSkipped(e)
+			return res, false
+		}
+		e.Action, e.Err = "convert", errConv
+		e.Message = fmt.Sprintf("Failed to convert %s (MIME: %s): %v", fPath, mimeType, errConv)
+		events.OnError(e)
+		return res, false
+	}
+	converted := e
+	converted.Action, converted.Result = "convert", &res
+	converted.Message = fmt.Sprintf("Successfully converted %s (MIME: %s) to %s", fPath, mimeType, outputFilePath) + describeResult(res, convOpts)
+	events.OnConverted(converted)
 
-	messages, err := runApp(*path, *force)
+	e.Action = "verify"
+	if !verify {
+		if !checkDecodable {
+			return res, true
+		}
+		if err := converter.CheckDecodable(outputFilePath, convOpts.Format); err != nil {
+			e.Err, e.Message = err, fmt.Sprintf("Output %s failed verification: %v", outputFilePath, err)
+			events.OnError(e)
+			return res, false
+		}
+		return res, true
+	}
 
-	for _, msg := range messages {
-		if strings.HasPrefix(msg, "ERROR:") {
-			fmt.Fprintln(os.Stderr, msg)
+	v, err := converter.Verify(fPath, outputFilePath, convOpts, minPSNR > 0)
+	if err == nil && v.PSNR < minPSNR {
+		err = fmt.Errorf("PSNR %.2f dB is below the required %g dB", v.PSNR, minPSNR)
+	}
+	if err != nil {
+		e.Err, e.Message = err, fmt.Sprintf("Output %s failed verification: %v", outputFilePath, err)
+		if rmErr := os.Remove(outputFilePath); rmErr != nil {
+			e.Message += fmt.Sprintf("; failed to remove it: %v", rmErr)
 		} else {
-			// Default to Stdout for INFO and other messages
-			fmt.Println(msg)
+			e.Message += "; removed it"
 		}
+		events.OnError(e)
+		return res, false
+	}
+	e.Message = fmt.Sprintf("Verified %s (%dx%d", outputFilePath, v.Width, v.Height)
+	if minPSNR > 0 {
+		e.Message += fmt.Sprintf(", PSNR %.2f dB", v.PSNR)
+	}
+	e.Message += ")"
+	events.OnInfo(e)
+	return res, true
+}
+
+// describeSavings explains why an output of res was discarded for not being
+// smaller than its input.
+func describeSavings(res converter.Result, convOpts converter.Options) string {
+	if convOpts.MinSavings > 0 && res.OutputSize < res.InputSize {
+		saved := 100 * float64(res.InputSize-res.OutputSize) / float64(res.InputSize)
+		return fmt.Sprintf("output of %d bytes saves only %.1f%% of %d bytes, below the %g%% minimum", res.OutputSize, saved, res.InputSize, convOpts.MinSavings)
+	}
+	return fmt.Sprintf("output of %d bytes is not smaller than the source of %d bytes", res.OutputSize, res.InputSize)
+}
+
+// describeResult returns the details of res worth reporting for convOpts:
+// the choices made by quality targets and by auto mode. It returns an empty
+// string when the converter made no choices.
+func describeResult(res converter.Result, convOpts converter.Options) string {
+	var desc string
+	if hasTarget(convOpts) {
+		desc += " " + describeTargetResult(res, convOpts)
+	}
+	if convOpts.Auto && res.OtherModeSize > 0 {
+		winner, loser := "lossy", "lossless"
+		if res.Lossless {
+			winner, loser = loser, winner
+		}
+		desc += fmt.Sprintf(" (auto mode: %s won, %d bytes vs %d bytes %s)", winner, res.OutputSize, res.OtherModeSize, loser)
+	}
+	return desc
+}
+
+// describeTargetResult summarises the quality, size and similarity chosen to
+// meet --target-size, --target-ssim or --target-psnr.
+func describeTargetResult(res converter.Result, convOpts converter.Options) string {
+	quality := "lossless"
+	if res.Quality != 0 {
+		quality = fmt.Sprintf("quality %g", res.Quality)
+	}
+	desc := fmt.Sprintf("(%s, %dx%d, %d bytes", quality, res.Width, res.Height, res.OutputSize)
+	switch {
+	case convOpts.TargetSSIM > 0:
+		desc += fmt.Sprintf(", SSIM %.4f", res.SSIM)
+		if res.SSIM < convOpts.TargetSSIM {
+			desc += ", target not met"
+		}
+	case convOpts.TargetPSNR > 0:
+		desc += fmt.Sprintf(", PSNR %.2f dB", res.PSNR)
+		if res.PSNR < convOpts.TargetPSNR {
+			desc += ", target not met"
+		}
+	}
+	return desc + ")"
+}
+
+// reencodeFile recompresses a WebP file in place and reports the outcome to events.
+func reencodeFile(events eventSink, fPath string, convOpts converter.Options) converter.Result {
+	e := event{Path: fPath, MIMEType: "image/webp", Output: fPath}
+	res, err := converter.ReencodeWebP(fPath, convOpts)
+	switch {
+	case err != nil:
+		e.Action, e.Err = "reencode", err
+		e.Message = fmt.Sprintf("Failed to re-encode %s (MIME: image/webp): %v", fPath, err)
+		events.OnError(e)
+	case !res.Written:
+		e.Action, e.Result = "skip-larger", &res
+		e.Message = fmt.Sprintf("Keeping original %s (%s)", fPath, describeSavings(res, convOpts))
+		events.OnSkipped(e)
+	default:
+		e.Action, e.Result = "reencode", &res
+		e.Message = fmt.Sprintf("Successfully re-encoded %s (%d -> %d bytes)", fPath, res.InputSize, res.OutputSize) + describeResult(res, convOpts)
+		events.OnConverted(e)
+	}
+	return res
+}
+
+// runConvert runs the "convert" subcommand, which is also what runs when
+// the program is invoked with flags only, e.g. "imageconverter --path X".
+// It exits the process on errors.
+func runConvert(args []string) {
+	f := newConvertFlags()
+	f.flags.Parse(args)
+	appOpts, level, err := f.options()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		f.flags.Usage()
+		os.Exit(1)
+	}
+
+	if f.configPath != "" {
+		appOpts.Config, err = config.Load(f.configPath)
+	} else {
+		appOpts.Config, err = config.Find(f.path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid configuration file: %v.\n", err)
+		os.Exit(1)
+	}
+
+	// Errors are logged to stderr and everything else to stdout, unless
+	// stdout is reserved for the events printed by --json. The progress bar
+	// is hidden while a line is logged.
+	var logOut, logErr io.Writer = os.Stdout, os.Stderr
+	if f.asJSON {
+		logOut = os.Stderr
+	}
+	if !f.quiet {
+		appOpts.Progress = newProgress(os.Stderr, nil)
+		logOut, logErr = progressWriter{logOut, appOpts.Progress}, progressWriter{logErr, appOpts.Progress}
+	}
+	logger := newLogger(level, f.logFormat, logOut, logErr)
+	slog.SetDefault(logger)
+	if appOpts.Progress != nil {
+		appOpts.Progress.log = logger
+	}
+	if f.asJSON {
+		appOpts.Events = newJSONSink(os.Stdout)
+	} else {
+		appOpts.Events = &logSink{log: logger, structured: f.logFormat == logFormatJSON}
+	}
+
+	if f.watch {
+		err = runWatch(f.path, appOpts, watcher.Options{Debounce: f.watchDebounce, PollInterval: f.watchPoll, Poll: f.watchPoll > 0})
+	} else {
+		err = runApp(f.path, appOpts)
 	}
 
 	if err != nil {
@@ -138,3 +613,256 @@ func main() {
 		os.Exit(1) // General error
 	}
 }
+
+// convertFlags holds the flags of the "convert" subcommand.
+type convertFlags struct {
+	flags *flag.FlagSet
+
+	path          string
+	force         bool
+	tiffPages     string
+	quality       float64
+	lossless      bool
+	mode          string
+	alphaQuality  float64
+	exact         bool
+	flatten       string
+	toSRGB        bool
+	maxWidth      int
+	maxHeight     int
+	reencodeWebP  bool
+	to            string
+	targetSize    string
+	targetSSIM    float64
+	targetPSNR    float64
+	after         string
+	nameTemplate  string
+	dryRun        bool
+	onlyIfSmaller savingsFlag
+	asJSON        bool
+	logLevel      string
+	logFormat     string
+	quiet         bool
+	verify        bool
+	verifyPSNR    float64
+	watch         bool
+	watchDebounce time.Duration
+	watchPoll     time.Duration
+	configPath    string
+	encoder       string
+}
+
+// newConvertFlags returns the flags of the "convert" subcommand, registered
+// on a new FlagSet.
+func newConvertFlags() *convertFlags {
+	f := &convertFlags{flags: flag.NewFlagSet("convert", flag.ExitOnError)}
+	flags := f.flags
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s convert --path PATH [flags]\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Converts an image, or every image in a directory tree. The path can also be given as the only argument.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&f.path, "path", "", "Input file or directory path (required)")
+	flags.StringVar(&f.path, "p", "", "Input file or directory path (alias for -path)")
+	flags.BoolVar(&f.force, "force", false, "Overwrite existing files")
+	flags.BoolVar(&f.force, "f", false, "Overwrite existing files (alias for -force)")
+	flags.StringVar(&f.tiffPages, "tiff-pages", tiffPagesFirst, "Pages to convert from multi-page TIFFs: 'first' or 'all' (one output per page)")
+	flags.Float64Var(&f.quality, "quality", converter.DefaultQuality, "Lossy WebP quality (1-100)")
+	flags.BoolVar(&f.lossless, "lossless", false, "Use lossless WebP encoding (same as --mode lossless)")
+	flags.StringVar(&f.mode, "mode", "", "WebP encoding mode: 'lossy' (default), 'lossless' or 'auto' (encode both, keep the smaller)")
+	flags.Float64Var(&f.alphaQuality, "alpha-quality", 100, "Lossy WebP alpha channel quality (1-100); lower values keep fewer levels of transparency")
+	flags.BoolVar(&f.exact, "exact", false, "Keep the RGB values of fully transparent pixels (lossless only)")
+	flags.StringVar(&f.flatten, "flatten", "", "Composite transparent images onto this background colour, e.g. '#ffffff', dropping the alpha channel")
+	flags.BoolVar(&f.toSRGB, "to-srgb", false, "Convert images with an embedded Adobe RGB, Display P3 or other RGB matrix/TRC ICC profile to sRGB, since the profile is not kept")
+	flags.IntVar(&f.maxWidth, "max-width", 0, "Downscale images wider than this many pixels (0 = no limit)")
+	flags.IntVar(&f.maxHeight, "max-height", 0, "Downscale images taller than this many pixels (0 = no limit)")
+	flags.BoolVar(&f.reencodeWebP, "reencode-webp", false, "Recompress existing WebP files in place, keeping the result only if it is smaller")
+	flags.StringVar(&f.to, "to", converter.FormatWebP, "Output format: 'webp', 'png' or 'jpeg'")
+	flags.StringVar(&f.targetSize, "target-size", "", "Largest output size per image, e.g. '100KB'; the quality is lowered (and the image downscaled if needed) to fit")
+	flags.Float64Var(&f.targetSSIM, "target-ssim", 0, "Use the lowest quality whose output reaches this SSIM against the source, e.g. 0.98")
+	flags.Float64Var(&f.targetPSNR, "target-psnr", 0, "Use the lowest quality whose output reaches this PSNR in dB against the source, e.g. 40")
+	flags.StringVar(&f.after, "after", afterKeep, "What to do with a source file once it has been converted: 'keep', 'delete' or 'move:<dir>'")
+	flags.StringVar(&f.nameTemplate, "name-template", "", "Output file name template with {name}, {ext}, {width}, {height}, {quality} and {hash} placeholders, e.g. '{name}.{ext}.webp' (default: {name} plus the output extension)")
+	flags.BoolVar(&f.dryRun, "dry-run", false, "Print the planned action for every file without decoding or writing anything")
+	flags.Var(&f.onlyIfSmaller, "only-if-smaller", "Only write outputs smaller than their source; '=N' requires at least N% savings")
+	flags.BoolVar(&f.asJSON, "json", false, "Print one JSON object per line for every file discovered, converted, skipped or failed, instead of log lines")
+	flags.StringVar(&f.logLevel, "log-level", "info", "Lowest level to log: 'debug' (adds sniffed MIME types and encoder decisions), 'info', 'warn' or 'error'")
+	flags.StringVar(&f.logFormat, "log-format", logFormatText, "Log format: 'text' ('LEVEL: message' lines) or 'json' (one JSON object per record)")
+	flags.BoolVar(&f.quiet, "quiet", false, "Do not show progress (a bar on a terminal, periodic lines on stderr otherwise)")
+	flags.BoolVar(&f.verify, "verify", false, "Decode every output and check its dimensions against the source; remove outputs that fail")
+	flags.Float64Var(&f.verifyPSNR, "verify-psnr", 0, "Also require each output's PSNR against the source to reach this many dB (implies --verify)")
+	flags.BoolVar(&f.watch, "watch", false, "After converting, keep running and convert new or modified files as they appear")
+	flags.DurationVar(&f.watchDebounce, "watch-debounce", watcher.DefaultDebounce, "How long a file must stay unchanged before --watch converts it")
+	flags.DurationVar(&f.watchPoll, "watch-poll", 0, "Poll for changes at this interval instead of using file system notifications (0 = notifications, polling only as a fallback)")
+	flags.StringVar(&f.configPath, "config", "", "Configuration file with per-glob settings (default: "+config.FileName+" in the input directory, if present)")
+	flags.StringVar(&f.encoder, "encoder", converter.DefaultWebPEncoder(), "WebP encoder backend (available: "+strings.Join(converter.WebPEncoderNames(), ", ")+")")
+	return f
+}
+
+// options validates the parsed flags and returns the options and log level
+// they select. The configuration file, events and progress are left to the
+// caller.
+func (f *convertFlags) options() (appOptions, slog.Level, error) {
+	if f.path == "" && f.flags.NArg() == 1 {
+		f.path = f.flags.Arg(0)
+	} else if f.flags.NArg() > 0 {
+		return appOptions{}, 0, fmt.Errorf("unexpected arguments: %s", strings.Join(f.flags.Args(), " "))
+	}
+	if f.path == "" {
+		return appOptions{}, 0, errors.New("input path is required; use --path or -p")
+	}
+
+	if f.tiffPages != tiffPagesFirst && f.tiffPages != tiffPagesAll {
+		return appOptions{}, 0, fmt.Errorf("invalid --tiff-pages value %q, expected 'first' or 'all'", f.tiffPages)
+	}
+	if f.quality < 1 || f.quality > 100 {
+		return appOptions{}, 0, fmt.Errorf("invalid --quality value %v, expected a number between 1 and 100", f.quality)
+	}
+	if f.alphaQuality < 1 || f.alphaQuality > 100 {
+		return appOptions{}, 0, fmt.Errorf("invalid --alpha-quality value %v, expected a number between 1 and 100", f.alphaQuality)
+	}
+	if _, err := converter.EncoderFor(f.to); err != nil {
+		return appOptions{}, 0, fmt.Errorf("invalid --to value: %w", err)
+	}
+	if f.encoder != "" || f.to == converter.FormatWebP {
+		if _, err := converter.WebPEncoder(f.encoder); err != nil {
+			return appOptions{}, 0, fmt.Errorf("invalid --encoder value: %w", err)
+		}
+	}
+	if f.maxWidth < 0 || f.maxHeight < 0 {
+		return appOptions{}, 0, errors.New("--max-width and --max-height must not be negative")
+	}
+
+	switch f.mode {
+	case "", config.ModeLossy, config.ModeLossless, config.ModeAuto:
+	default:
+		return appOptions{}, 0, fmt.Errorf("invalid --mode value %q, expected 'lossy', 'lossless' or 'auto'", f.mode)
+	}
+	if f.lossless && f.mode != "" && f.mode != config.ModeLossless {
+		return appOptions{}, 0, fmt.Errorf("--lossless conflicts with --mode %s", f.mode)
+	}
+
+	if f.verifyPSNR < 0 {
+		return appOptions{}, 0, errors.New("--verify-psnr must not be negative")
+	}
+	if f.watch && f.dryRun {
+		return appOptions{}, 0, errors.New("--watch cannot be combined with --dry-run")
+	}
+
+	afterAct, err := parseAfterAction(f.after)
+	if err != nil {
+		return appOptions{}, 0, fmt.Errorf("invalid --after value: %w", err)
+	}
+	nameTmpl, err := parseNameTemplate(f.nameTemplate)
+	if err != nil {
+		return appOptions{}, 0, fmt.Errorf("invalid --name-template value: %w", err)
+	}
+
+	level, err := parseLogLevel(f.logLevel)
+	if err != nil {
+		return appOptions{}, 0, fmt.Errorf("invalid --log-level value: %w", err)
+	}
+	if f.logFormat != logFormatText && f.logFormat != logFormatJSON {
+		return appOptions{}, 0, fmt.Errorf("invalid --log-format value %q, expected 'text' or 'json'", f.logFormat)
+	}
+
+	// An empty --flatten is rejected rather than ignored.
+	flattenGiven := false
+	f.flags.Visit(func(fl *flag.Flag) { flattenGiven = flattenGiven || fl.Name == "flatten" })
+	var background color.Color
+	if flattenGiven {
+		c, err := config.ParseColor(f.flatten)
+		if err != nil {
+			return appOptions{}, 0, fmt.Errorf("invalid --flatten value: %w", err)
+		}
+		background = c
+	}
+
+	var targetBytes int64
+	if f.targetSize != "" {
+		if targetBytes, err = config.ParseByteSize(f.targetSize); err != nil {
+			return appOptions{}, 0, fmt.Errorf("invalid --target-size value: %w", err)
+		}
+	}
+	if f.targetSSIM < 0 || f.targetSSIM > 1 || f.targetPSNR < 0 {
+		return appOptions{}, 0, errors.New("--target-ssim must be between 0 and 1 and --target-psnr must not be negative")
+	}
+
+	// Flags given explicitly take precedence over the configuration file.
+	var overrides config.Settings
+	f.flags.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "quality":
+			overrides.Quality = &f.quality
+		case "lossless":
+			if f.lossless {
+				losslessMode := config.ModeLossless
+				overrides.Mode = &losslessMode
+			}
+		case "mode":
+			overrides.Mode = &f.mode
+		case "alpha-quality":
+			overrides.AlphaQuality = &f.alphaQuality
+		case "exact":
+			overrides.Exact = &f.exact
+		case "flatten":
+			if c, ok := background.(color.NRGBA); ok {
+				overrides.Flatten = &c
+			}
+		case "to-srgb":
+			overrides.ToSRGB = &f.toSRGB
+		case "max-width":
+			overrides.MaxWidth = &f.maxWidth
+		case "max-height":
+			overrides.MaxHeight = &f.maxHeight
+		case "target-size":
+			overrides.TargetSize = &targetBytes
+		case "target-ssim":
+			overrides.TargetSSIM = &f.targetSSIM
+		case "target-psnr":
+			overrides.TargetPSNR = &f.targetPSNR
+		case "encoder":
+			overrides.Encoder = &f.encoder
+		}
+	})
+
+	opts := appOptions{
+		Force:        f.force,
+		TIFFPages:    f.tiffPages,
+		ReencodeWebP: f.reencodeWebP,
+		Overrides:    overrides,
+		NameTemplate: nameTmpl,
+		DryRun:       f.dryRun,
+		Verify:       f.verify || f.verifyPSNR > 0,
+		VerifyPSNR:   f.verifyPSNR,
+		After:        afterAct,
+		Convert: converter.Options{
+			Format:     f.to,
+			Encoder:    f.encoder,
+			Quality:    float32(f.quality),
+			Lossless:   f.lossless || f.mode == config.ModeLossless,
+			Auto:       f.mode == config.ModeAuto,
+			MaxWidth:   f.maxWidth,
+			MaxHeight:  f.maxHeight,
+			TargetSize: targetBytes,
+			TargetSSIM: f.targetSSIM,
+			TargetPSNR: f.targetPSNR,
+
+			AlphaQuality:  float32(f.alphaQuality),
+			Exact:         f.exact,
+			Background:    background,
+			ToSRGB:        f.toSRGB,
+			OnlyIfSmaller: f.onlyIfSmaller.set,
+			MinSavings:    f.onlyIfSmaller.percent,
+		},
+	}
+	if err := opts.Convert.Validate(); err != nil {
+		return appOptions{}, 0, err
+	}
+	if nameTmpl.needsQuality && hasTarget(opts.Convert) {
+		return appOptions{}, 0, errors.New("--name-template cannot use {quality} with --target-size, --target-ssim or --target-psnr, which pick the quality per image")
+	}
+	return opts, level, nil
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"image"
 	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"imageconverter/internal/config"
+	"imageconverter/internal/converter"
+	"imageconverter/internal/imageinfo"
 )
 
 // Helper function to create a dummy image file for integration tests
@@ -98,6 +106,45 @@ func findMessage(messages []string, substr string) bool {
 	return false
 }
 
+// recordedEvent is an event received by a recordingSink, with its kind.
+type recordedEvent struct {
+	kind string
+	event
+}
+
+// recordingSink records the events of a run.
+type recordingSink struct {
+	events []recordedEvent
+}
+
+func (s *recordingSink) OnInfo(e event)       { s.record(eventInfo, e) }
+func (s *recordingSink) OnDiscovered(e event) { s.record(eventDiscovered, e) }
+func (s *recordingSink) OnConverted(e event)  { s.record(eventConverted, e) }
+func (s *recordingSink) OnSkipped(e event)    { s.record(eventSkipped, e) }
+func (s *recordingSink) OnError(e event)      { s.record(eventError, e) }
+
+func (s *recordingSink) record(kind string, e event) {
+	s.events = append(s.events, recordedEvent{kind, e})
+}
+
+// messages returns the recorded events as the CLI prints them.
+func (s *recordingSink) messages() []string {
+	var messages []string
+	for _, e := range s.events {
+		messages = append(messages, levelName(eventLevel(e.kind, e.event))+": "+e.Message)
+	}
+	return messages
+}
+
+// recordRun calls runApp with a recordingSink and returns the log lines it
+// would have printed.
+func recordRun(inputPath string, opts appOptions) ([]string, error) {
+	sink := &recordingSink{}
+	opts.Events = sink
+	err := runApp(inputPath, opts)
+	return sink.messages(), err
+}
+
 func TestIntegration_ConvertDirectory(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "test_integration_input_*")
 	if err != nil {
@@ -131,7 +178,7 @@ func TestIntegration_ConvertDirectory(t *testing.T) {
 	docJPEGPath := createTestFile(t, tmpDir, "document.jpg", []byte("this is plain text, not a jpeg"))
 
 
-	messages, err := runApp(tmpDir, false)
+	messages, err := recordRun(tmpDir, appOptions{})
 	if err != nil {
 		t.Fatalf("runApp failed: %v. Messages: %v", err, messages)
 	}
@@ -157,7 +204,7 @@ func TestIntegration_ConvertDirectory(t *testing.T) {
 	if !findMessage(messages, "INFO: Successfully converted "+imageTxtPath) {
 		t.Errorf("Missing success message for %s (PNG disguised as .txt). Messages: %v", imageTxtPath, messages)
 	}
-	if !findMessage(messages, "INFO: File: "+imageTxtPath+", Detected MIME type: image/png") {
+	if !findMessage(messages, "DEBUG: File: "+imageTxtPath+", Detected MIME type: image/png") {
 		t.Errorf("Missing image/png MIME type detection message for %s. Messages: %v", imageTxtPath, messages)
 	}
 
@@ -189,7 +236,7 @@ func TestIntegration_ForceOverwrite(t *testing.T) {
 	webpPath := filepath.Join(tmpDir, "image.webp")
 
 	// First run, create .webp
-	messages, errRun1 := runApp(tmpDir, false)
+	messages, errRun1 := recordRun(tmpDir, appOptions{})
 	if errRun1 != nil {
 		t.Fatalf("runApp (1st run) failed: %v. Messages: %v", errRun1, messages)
 	}
@@ -201,7 +248,7 @@ func TestIntegration_ForceOverwrite(t *testing.T) {
 	time.Sleep(10 * time.Millisecond) // Ensure mod time can change if file is rewritten
 
 	// Second run, no force, should skip
-	messages, errRun2 := runApp(tmpDir, false)
+	messages, errRun2 := recordRun(tmpDir, appOptions{})
 	if errRun2 != nil {
 		t.Fatalf("runApp (2nd run, no force) failed: %v. Messages: %v", errRun2, messages)
 	}
@@ -218,7 +265,7 @@ func TestIntegration_ForceOverwrite(t *testing.T) {
 
 
 	// Third run, with force, should overwrite
-	messages, errRun3 := runApp(tmpDir, true)
+	messages, errRun3 := recordRun(tmpDir, appOptions{Force: true})
 	if errRun3 != nil {
 		t.Fatalf("runApp (3rd run, with force) failed: %v. Messages: %v", errRun3, messages)
 	}
@@ -244,7 +291,7 @@ func TestIntegration_SingleFile(t *testing.T) {
 	pngPath := createIntegrationTestImage(t, tmpDir, "single.png", "png")
 	expectedWebpPath := filepath.Join(tmpDir, "single.webp")
 
-	messages, errRun := runApp(pngPath, false) // Pass the direct file path
+	messages, errRun := recordRun(pngPath, appOptions{}) // Pass the direct file path
 	if errRun != nil {
 		t.Fatalf("runApp failed for single file: %v. Messages: %v", errRun, messages)
 	}
@@ -266,7 +313,7 @@ func TestIntegration_PathNonExistent(t *testing.T) {
 	_ = os.RemoveAll(filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(nonExistentPath)))))
 
 
-	messages, err := runApp(nonExistentPath, false)
+	messages, err := recordRun(nonExistentPath, appOptions{})
 	if err == nil {
 		t.Fatalf("Expected runApp to return an error for non-existent path, got nil. Messages: %v", messages)
 	}
@@ -274,3 +321,838 @@ func TestIntegration_PathNonExistent(t *testing.T) {
 		t.Errorf("Expected error message to contain 'does not exist', got: %v", err.Error())
 	}
 }
+
+func TestIntegration_WebPInput(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test_webp_input_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp input dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pngPath := createIntegrationTestImage(t, tmpDir, "image.png", "png")
+	webpPath := filepath.Join(tmpDir, "image.webp")
+	if messages, err := recordRun(pngPath, appOptions{Convert: converter.Options{Quality: 100}}); err != nil {
+		t.Fatalf("runApp failed to create WebP: %v. Messages: %v", err, messages)
+	}
+	if err := os.Remove(pngPath); err != nil {
+		t.Fatalf("Failed to remove %s: %v", pngPath, err)
+	}
+
+	// Without --reencode-webp, WebP inputs are skipped.
+	messages, err := recordRun(tmpDir, appOptions{})
+	if err != nil {
+		t.Fatalf("runApp failed: %v. Messages: %v", err, messages)
+	}
+	if !findMessage(messages, "INFO: Skipping file "+webpPath+" (detected MIME type: image/webp, already WebP") {
+		t.Errorf("Missing skip message for WebP input. Messages: %v", messages)
+	}
+
+	// With --reencode-webp, the file is either recompressed or kept.
+	messages, err = recordRun(tmpDir, appOptions{ReencodeWebP: true, Convert: converter.Options{Quality: 10}})
+	if err != nil {
+		t.Fatalf("runApp (re-encode) failed: %v. Messages: %v", err, messages)
+	}
+	if !findMessage(messages, "INFO: Successfully re-encoded "+webpPath) && !findMessage(messages, "INFO: Keeping original "+webpPath) {
+		t.Errorf("Missing re-encode message for WebP input. Messages: %v", messages)
+	}
+	checkFileExists(t, webpPath)
+}
+
+func TestIntegration_ReverseConversion(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test_reverse_input_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp input dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pngPath := createIntegrationTestImage(t, tmpDir, "image.png", "png")
+	webpPath := filepath.Join(tmpDir, "image.webp")
+	if messages, err := recordRun(pngPath, appOptions{}); err != nil {
+		t.Fatalf("runApp failed to create WebP: %v. Messages: %v", err, messages)
+	}
+	if err := os.Remove(pngPath); err != nil {
+		t.Fatalf("Failed to remove %s: %v", pngPath, err)
+	}
+
+	messages, err := recordRun(tmpDir, appOptions{Convert: converter.Options{Format: converter.FormatJPEG}})
+	if err != nil {
+		t.Fatalf("runApp (to jpeg) failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, filepath.Join(tmpDir, "image.jpg"))
+	if !findMessage(messages, "INFO: Successfully converted "+webpPath) {
+		t.Errorf("Missing success message for WebP to JPEG. Messages: %v", messages)
+	}
+
+	// image.jpg and image.webp would both become image.png.
+	messages, err = recordRun(tmpDir, appOptions{Convert: converter.Options{Format: converter.FormatPNG}})
+	if err != nil {
+		t.Fatalf("runApp (to png) failed: %v. Messages: %v", err, messages)
+	}
+	checkFileDoesNotExist(t, filepath.Join(tmpDir, "image.png"))
+	if !findMessage(messages, "collides with the output of") {
+		t.Errorf("Missing collision error. Messages: %v", messages)
+	}
+	if err := os.Remove(filepath.Join(tmpDir, "image.jpg")); err != nil {
+		t.Fatalf("Failed to remove image.jpg: %v", err)
+	}
+
+	messages, err = recordRun(tmpDir, appOptions{Convert: converter.Options{Format: converter.FormatPNG}})
+	if err != nil {
+		t.Fatalf("runApp (to png) failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, filepath.Join(tmpDir, "image.png"))
+
+	// PNG inputs are already in the output format and are left alone.
+	messages, err = recordRun(tmpDir, appOptions{Convert: converter.Options{Format: converter.FormatPNG}})
+	if err != nil {
+		t.Fatalf("runApp (to png, 2nd run) failed: %v. Messages: %v", err, messages)
+	}
+	if !findMessage(messages, "already in the output format") {
+		t.Errorf("Missing same-format skip message. Messages: %v", messages)
+	}
+
+	if _, err := recordRun(tmpDir, appOptions{Convert: converter.Options{Format: "gif"}}); err == nil {
+		t.Errorf("Expected runApp to reject an unsupported output format")
+	}
+}
+
+func TestIntegration_OnlyIfSmaller(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test_only_if_smaller_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp input dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// A tiny GIF is smaller than the same image as PNG, so no PNG is written.
+	gifPath := createIntegrationTestImage(t, tmpDir, "tiny.gif", "gif")
+	pngPath := filepath.Join(tmpDir, "tiny.png")
+	opts := appOptions{Convert: converter.Options{Format: converter.FormatPNG, OnlyIfSmaller: true}}
+	messages, err := recordRun(gifPath, opts)
+	if err != nil {
+		t.Fatalf("runApp failed: %v. Messages: %v", err, messages)
+	}
+	checkFileDoesNotExist(t, pngPath)
+	if !findMessage(messages, "INFO: Skipping output "+pngPath+" (output of ") {
+		t.Errorf("Missing only-if-smaller skip message. Messages: %v", messages)
+	}
+
+	opts.Convert.OnlyIfSmaller = false
+	if messages, err := recordRun(gifPath, opts); err != nil {
+		t.Fatalf("runApp without --only-if-smaller failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, pngPath)
+}
+
+func TestSavingsFlag(t *testing.T) {
+	for input, want := range map[string]savingsFlag{
+		"true":  {set: true},
+		"false": {},
+		"10":    {set: true, percent: 10},
+		"12.5%": {set: true, percent: 12.5},
+	} {
+		var got savingsFlag
+		if err := got.Set(input); err != nil || got != want {
+			t.Errorf("Set(%q) = %+v, %v; expected %+v", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"abc", "-1", "100"} {
+		var f savingsFlag
+		if err := f.Set(input); err == nil {
+			t.Errorf("Expected an error for Set(%q)", input)
+		}
+	}
+}
+
+func TestConvertFlags(t *testing.T) {
+	f := newConvertFlags()
+	f.flags.Parse([]string{"--quality", "70", "--flatten", "#fff", "photos"})
+	opts, level, err := f.options()
+	if err != nil {
+		t.Fatalf("options() failed: %v", err)
+	}
+	if f.path != "photos" || level != slog.LevelInfo || opts.Convert.Quality != 70 || opts.Convert.Background == nil {
+		t.Errorf("options() = %+v, %v for path %q", opts, level, f.path)
+	}
+	if opts.Overrides.Quality == nil || *opts.Overrides.Quality != 70 || opts.Overrides.MaxWidth != nil {
+		t.Errorf("Expected only the given flags as overrides, got %+v", opts.Overrides)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"a", "b"},
+		{"--path", "a", "--quality", "0"},
+		{"--path", "a", "--lossless", "--mode", "auto"},
+		{"--path", "a", "--flatten="},
+		{"--path", "a", "--target-size", "10KB", "--target-psnr", "40"},
+		{"--path", "a", "--watch", "--dry-run"},
+		{"--path", "a", "--log-format", "xml"},
+		{"--path", "a", "--name-template", "{name}-q{quality}.webp", "--target-ssim", "0.95"},
+	} {
+		f := newConvertFlags()
+		f.flags.Parse(args)
+		if _, _, err := f.options(); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+
+	// --exact needs lossless encoding, unless the backend is lossless anyway.
+	f = newConvertFlags()
+	f.flags.Parse([]string{"--path", "a", "--exact"})
+	if _, _, err := f.options(); (err == nil) == converter.UsesQuality(converter.Options{}) {
+		t.Errorf("options() with --exact returned %v", err)
+	}
+}
+
+func TestIntegration_AfterAction(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test_after_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp input dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	srcDir := filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "nested"), 0755); err != nil {
+		t.Fatalf("Failed to create source dirs: %v", err)
+	}
+	movedDir := filepath.Join(tmpDir, "originals")
+
+	pngPath := createIntegrationTestImage(t, srcDir, "image.png", "png")
+	nestedPath := createIntegrationTestImage(t, filepath.Join(srcDir, "nested"), "image.jpg", "jpeg")
+	textPath := createTestFile(t, srcDir, "notes.txt", []byte("not an image"))
+
+	messages, err := recordRun(srcDir, appOptions{After: afterAction{Kind: afterMove, Dir: movedDir}})
+	if err != nil {
+		t.Fatalf("runApp with --after=move failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, filepath.Join(srcDir, "image.webp"))
+	checkFileExists(t, filepath.Join(srcDir, "nested", "image.webp"))
+	checkFileDoesNotExist(t, pngPath)
+	checkFileDoesNotExist(t, nestedPath)
+	checkFileExists(t, filepath.Join(movedDir, "image.png"))
+	checkFileExists(t, filepath.Join(movedDir, "nested", "image.jpg"))
+	checkFileExists(t, textPath) // Unsupported files are never touched.
+	if !findMessage(messages, "INFO: Moved original "+pngPath+" to "+filepath.Join(movedDir, "image.png")) {
+		t.Errorf("Missing move message. Messages: %v", messages)
+	}
+
+	// Outputs that already exist are not written again, so the source is kept.
+	gifPath := createIntegrationTestImage(t, srcDir, "image.gif", "gif")
+	messages, err = recordRun(gifPath, appOptions{After: afterAction{Kind: afterDelete}})
+	if err != nil {
+		t.Fatalf("runApp with --after=delete failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, gifPath)
+
+	messages, err = recordRun(gifPath, appOptions{Force: true, After: afterAction{Kind: afterDelete}})
+	if err != nil {
+		t.Fatalf("runApp with --after=delete --force failed: %v. Messages: %v", err, messages)
+	}
+	checkFileDoesNotExist(t, gifPath)
+	if !findMessage(messages, "INFO: Deleted original "+gifPath) {
+		t.Errorf("Missing delete message. Messages: %v", messages)
+	}
+}
+
+// TestAfterAction_SourceIsOutput checks that an original that was written
+// over by its own output is neither deleted nor moved.
+func TestAfterAction_SourceIsOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+	pngPath := createIntegrationTestImage(t, tmpDir, "a.png", "png")
+	for _, after := range []afterAction{{Kind: afterDelete}, {Kind: afterMove, Dir: filepath.Join(tmpDir, "moved")}} {
+		sink := &recordingSink{}
+		after.apply(sink, tmpDir, pngPath, []string{filepath.Join(tmpDir, ".", "a.png")})
+		checkFileExists(t, pngPath)
+		if len(sink.events) != 1 || sink.events[0].kind != eventError {
+			t.Errorf("--after %s: expected one error event, got %v", after.Kind, sink.messages())
+		}
+	}
+}
+
+func TestParseAfterAction(t *testing.T) {
+	for input, want := range map[string]afterAction{
+		"":            {Kind: afterKeep},
+		"keep":        {Kind: afterKeep},
+		"delete":      {Kind: afterDelete},
+		"move:/tmp/x": {Kind: afterMove, Dir: "/tmp/x"},
+	} {
+		got, err := parseAfterAction(input)
+		if err != nil || got != want {
+			t.Errorf("parseAfterAction(%q) = %+v, %v; expected %+v", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"move:", "move", "remove"} {
+		if _, err := parseAfterAction(input); err == nil {
+			t.Errorf("Expected an error for parseAfterAction(%q)", input)
+		}
+	}
+}
+
+func TestIntegration_DryRun(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test_dry_run_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp input dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pngPath := createIntegrationTestImage(t, tmpDir, "new.png", "png")
+	jpegPath := createIntegrationTestImage(t, tmpDir, "existing.jpg", "jpeg")
+	existingOutput := createTestFile(t, tmpDir, "existing.webp", []byte("placeholder"))
+	textPath := createTestFile(t, tmpDir, "notes.txt", []byte("not an image"))
+
+	messages, err := recordRun(tmpDir, appOptions{DryRun: true, After: afterAction{Kind: afterDelete}})
+	if err != nil {
+		t.Fatalf("runApp with --dry-run failed: %v. Messages: %v", err, messages)
+	}
+	for _, want := range []string{
+		"PLAN: convert " + pngPath + " -> " + filepath.Join(tmpDir, "new.webp"),
+		"PLAN: delete " + pngPath,
+		"PLAN: skip-exists " + jpegPath + " (output " + existingOutput + " exists",
+		"PLAN: skip-unsupported " + textPath,
+	} {
+		if !findMessage(messages, want) {
+			t.Errorf("Missing dry-run message %q. Messages: %v", want, messages)
+		}
+	}
+	if findMessage(messages, "PLAN: delete "+jpegPath) {
+		t.Errorf("Expected no after-action for a skipped file. Messages: %v", messages)
+	}
+
+	checkFileDoesNotExist(t, filepath.Join(tmpDir, "new.webp"))
+	checkFileExists(t, pngPath)
+	if data, err := os.ReadFile(existingOutput); err != nil || string(data) != "placeholder" {
+		t.Errorf("Expected %s to be left untouched, got %q, %v", existingOutput, data, err)
+	}
+}
+
+// TestIntegration_ReverseConversionOverOriginal checks that converting WebP
+// back to PNG with --force does not overwrite the PNG it was made from,
+// which is skipped as already being in the output format.
+func TestIntegration_ReverseConversionOverOriginal(t *testing.T) {
+	tmpDir := t.TempDir()
+	pngPath := createIntegrationTestImage(t, tmpDir, "a.png", "png")
+	webpPath := filepath.Join(tmpDir, "a.webp")
+	if messages, err := recordRun(pngPath, appOptions{}); err != nil {
+		t.Fatalf("runApp failed to create WebP: %v. Messages: %v", err, messages)
+	}
+	original, err := os.ReadFile(pngPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := recordRun(tmpDir, appOptions{Force: true, Convert: converter.Options{Format: converter.FormatPNG}})
+	if err != nil {
+		t.Fatalf("runApp (to png) failed: %v. Messages: %v", err, messages)
+	}
+	if !findMessage(messages, "ERROR: Failed to convert "+webpPath) {
+		t.Errorf("Expected the conversion of %s to be refused. Messages: %v", webpPath, messages)
+	}
+	if data, err := os.ReadFile(pngPath); err != nil || !bytes.Equal(data, original) {
+		t.Errorf("%s was overwritten: %v", pngPath, err)
+	}
+}
+
+func TestIntegration_NameTemplate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test_name_template_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp input dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	jpegPath := createIntegrationTestImage(t, tmpDir, "photo.jpg", "jpeg")
+	pngPath := createIntegrationTestImage(t, tmpDir, "photo.png", "png")
+
+	// By default both sources map to photo.webp, which is reported for each.
+	messages, err := recordRun(tmpDir, appOptions{})
+	if err != nil {
+		t.Fatalf("runApp failed: %v. Messages: %v", err, messages)
+	}
+	checkFileDoesNotExist(t, filepath.Join(tmpDir, "photo.webp"))
+	for _, src := range []string{jpegPath, pngPath} {
+		if !findMessage(messages, "ERROR: Failed to convert "+src) {
+			t.Errorf("Missing collision error for %s. Messages: %v", src, messages)
+		}
+	}
+
+	tmpl, err := parseNameTemplate("{name}.{ext}.webp")
+	if err != nil {
+		t.Fatalf("parseNameTemplate failed: %v", err)
+	}
+	messages, err = recordRun(tmpDir, appOptions{NameTemplate: tmpl})
+	if err != nil {
+		t.Fatalf("runApp with a name template failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, filepath.Join(tmpDir, "photo.jpg.webp"))
+	checkFileExists(t, filepath.Join(tmpDir, "photo.png.webp"))
+
+	// A template that names the source itself is refused, even with --force.
+	srcDir := filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", srcDir, err)
+	}
+	srcPath := createIntegrationTestImage(t, srcDir, "a.png", "png")
+	tmpl, err = parseNameTemplate("{name}.{ext}")
+	if err != nil {
+		t.Fatalf("parseNameTemplate failed: %v", err)
+	}
+	messages, err = recordRun(srcDir, appOptions{NameTemplate: tmpl, Force: true, After: afterAction{Kind: afterDelete}})
+	if err != nil {
+		t.Fatalf("runApp failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, srcPath)
+	if !findMessage(messages, "ERROR: Failed to convert "+srcPath) || findMessage(messages, "Deleted original") {
+		t.Errorf("Expected the conversion to be refused. Messages: %v", messages)
+	}
+}
+
+// TestIntegration_NameTemplateOverSource checks that --force does not let a
+// template overwrite another source of the batch.
+func TestIntegration_NameTemplateOverSource(t *testing.T) {
+	tmpDir := t.TempDir()
+	pngPath := createIntegrationTestImage(t, tmpDir, "a.png", "png")
+	jpegPath := createIntegrationTestImage(t, tmpDir, "a.jpg", "jpeg")
+	original, err := os.ReadFile(pngPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := parseNameTemplate("{name}.png")
+	if err != nil {
+		t.Fatalf("parseNameTemplate failed: %v", err)
+	}
+	messages, err := recordRun(tmpDir, appOptions{NameTemplate: tmpl, Force: true, Convert: converter.Options{Format: converter.FormatPNG}})
+	if err != nil {
+		t.Fatalf("runApp failed: %v. Messages: %v", err, messages)
+	}
+	if !findMessage(messages, "ERROR: Failed to convert "+jpegPath) || !findMessage(messages, "would overwrite the source file "+pngPath) {
+		t.Errorf("Expected the conversion of %s to be refused. Messages: %v", jpegPath, messages)
+	}
+	if data, err := os.ReadFile(pngPath); err != nil || !bytes.Equal(data, original) {
+		t.Errorf("%s was modified: %v", pngPath, err)
+	}
+}
+
+func TestNameTemplate_Placeholders(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test_name_placeholders_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp input dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pngPath := createIntegrationTestImage(t, tmpDir, "logo.png", "png")
+	encoder, err := converter.EncoderFor(converter.FormatJPEG)
+	if err != nil {
+		t.Fatalf("EncoderFor failed: %v", err)
+	}
+
+	tmpl, err := parseNameTemplate("{name}-{width}x{height}-q{quality}-{hash}.jpg")
+	if err != nil {
+		t.Fatalf("parseNameTemplate failed: %v", err)
+	}
+	outputs, err := tmpl.outputs(pngPath, 2, encoder, converter.Options{Format: converter.FormatJPEG, Quality: 75})
+	if err != nil {
+		t.Fatalf("outputs failed: %v", err)
+	}
+	hash, err := fileHash(pngPath)
+	if err != nil || len(hash) != 8 {
+		t.Fatalf("fileHash = %q, %v; expected 8 hex digits", hash, err)
+	}
+	for page, output := range outputs {
+		want := filepath.Join(tmpDir, fmt.Sprintf("logo-page%d-1x1-q75-%s.jpg", page+1, hash))
+		if output != want {
+			t.Errorf("Page %d: expected output %s, got %s", page+1, want, output)
+		}
+	}
+	// A target picks the quality per image, so {quality} cannot name the
+	// output, even when the target comes from a configuration file.
+	if _, err := tmpl.outputs(pngPath, 1, encoder, converter.Options{Format: converter.FormatJPEG, TargetSize: 1000}); err == nil {
+		t.Errorf("Expected an error for {quality} with a target size")
+	}
+
+	for _, bad := range []string{"{nme}.webp", "{name.webp", "name}.webp", "out/{name}.webp"} {
+		if _, err := parseNameTemplate(bad); err == nil {
+			t.Errorf("Expected an error for template %q", bad)
+		}
+	}
+}
+
+func TestIntegration_ConfigFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test_config_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp input dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(filepath.Join(tmpDir, "photos"), 0755); err != nil {
+		t.Fatalf("Failed to create photos dir: %v", err)
+	}
+	createTestFile(t, tmpDir, config.FileName, []byte("quality: 60\nrules:\n  photos/**: quality 90\n"))
+	createIntegrationTestImage(t, tmpDir, "logo.png", "png")
+	createIntegrationTestImage(t, filepath.Join(tmpDir, "photos"), "beach.png", "png")
+
+	cfg, err := config.Find(tmpDir)
+	if err != nil || cfg == nil {
+		t.Fatalf("config.Find failed: %v, %v", cfg, err)
+	}
+	// {quality} shows which settings were applied to each file.
+	tmpl, err := parseNameTemplate("{name}-q{quality}.jpg")
+	if err != nil {
+		t.Fatalf("parseNameTemplate failed: %v", err)
+	}
+	opts := appOptions{
+		Config:       cfg,
+		NameTemplate: tmpl,
+		Convert:      converter.Options{Format: converter.FormatJPEG, Quality: converter.DefaultQuality},
+	}
+	if messages, err := recordRun(tmpDir, opts); err != nil {
+		t.Fatalf("runApp with a config file failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, filepath.Join(tmpDir, "logo-q60.jpg"))
+	checkFileExists(t, filepath.Join(tmpDir, "photos", "beach-q90.jpg"))
+
+	// Flags given on the command line win over the file.
+	quality := 50.0
+	opts.Overrides = config.Settings{Quality: &quality}
+	if messages, err := recordRun(tmpDir, opts); err != nil {
+		t.Fatalf("runApp with overrides failed: %v. Messages: %v", err, messages)
+	}
+	checkFileExists(t, filepath.Join(tmpDir, "logo-q50.jpg"))
+	checkFileExists(t, filepath.Join(tmpDir, "photos", "beach-q50.jpg"))
+}
+
+// TestIntegration_WatchedFile converts single files the way --watch does,
+// below the watched directory.
+func TestIntegration_WatchedFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "nested"), 0755); err != nil {
+		t.Fatalf("Failed to create source dirs: %v", err)
+	}
+	movedDir := filepath.Join(tmpDir, "originals")
+	pngPath := createIntegrationTestImage(t, filepath.Join(srcDir, "nested"), "image.png", "png")
+
+	var written []string
+	sink := &recordingSink{}
+	session, err := newWatchSession(srcDir, appOptions{
+		Root:     srcDir,
+		Events:   sink,
+		OnOutput: func(source, output string) { written = append(written, output) },
+		After:    afterAction{Kind: afterMove, Dir: movedDir},
+	})
+	if err != nil {
+		t.Fatalf("newWatchSession failed: %v", err)
+	}
+	session.convert(pngPath)
+	output := filepath.Join(srcDir, "nested", "image.webp")
+	if len(written) != 1 || written[0] != output {
+		t.Errorf("OnOutput reported %v, expected [%s]", written, output)
+	}
+	// The original keeps its path relative to the watched directory.
+	checkFileExists(t, filepath.Join(movedDir, "nested", "image.png"))
+	// The run's settings are not repeated for every file.
+	if messages := sink.messages(); findMessage(messages, "INFO: Input path: "+pngPath) || findMessage(messages, "INFO: Processing files...") {
+		t.Errorf("Settings repeated for a watched file. Messages: %v", messages)
+	}
+}
+
+// TestIntegration_WatchedFileChanged checks that a source edited after its
+// first conversion is converted again over its output.
+func TestIntegration_WatchedFileChanged(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := createIntegrationTestImage(t, tmpDir, "image.jpg", "jpeg")
+	sink := &recordingSink{}
+	session, err := newWatchSession(tmpDir, appOptions{Root: tmpDir, Events: sink})
+	if err != nil {
+		t.Fatalf("newWatchSession failed: %v", err)
+	}
+	session.convert(jpgPath)
+	session.convert(jpgPath)
+
+	converted := 0
+	for _, e := range sink.events {
+		if e.kind == eventConverted {
+			converted++
+		}
+		if e.kind == eventSkipped || e.kind == eventError {
+			t.Errorf("Unexpected %s event: %s", e.kind, e.Message)
+		}
+	}
+	if converted != 2 {
+		t.Errorf("Expected the file to be converted twice, got %d. Messages: %v", converted, sink.messages())
+	}
+}
+
+// TestIntegration_WatchedCollisions checks that watched files are checked
+// for collisions with the sources and outputs seen before, and that WebP
+// files re-encoded in place are not ignored afterwards.
+func TestIntegration_WatchedCollisions(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := createIntegrationTestImage(t, tmpDir, "photo.jpg", "jpeg")
+	sink := &recordingSink{}
+	session, err := newWatchSession(tmpDir, appOptions{Root: tmpDir, Events: sink, ReencodeWebP: true})
+	if err != nil {
+		t.Fatalf("newWatchSession failed: %v", err)
+	}
+	session.convert(jpgPath)
+	webpPath := filepath.Join(tmpDir, "photo.webp")
+	if !session.written[pathKey(webpPath)] {
+		t.Errorf("%s is not ignored after being written", webpPath)
+	}
+
+	// photo.png maps to the output of photo.jpg.
+	pngPath := createIntegrationTestImage(t, tmpDir, "photo.png", "png")
+	session.convert(pngPath)
+	if messages := sink.messages(); !findMessage(messages, "ERROR: Failed to convert "+pngPath) {
+		t.Errorf("Missing collision error for %s. Messages: %v", pngPath, messages)
+	}
+
+	// A WebP file re-encoded over itself keeps being watched.
+	otherWebP := filepath.Join(tmpDir, "other.webp")
+	data, err := os.ReadFile(webpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(otherWebP, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	session.convert(otherWebP)
+	if session.written[pathKey(otherWebP)] {
+		t.Errorf("%s is ignored after being re-encoded in place", otherWebP)
+	}
+}
+
+func TestRunVerify(t *testing.T) {
+	tmpDir := t.TempDir()
+	pngPath := createIntegrationTestImage(t, tmpDir, "image.png", "png")
+	createTestFile(t, tmpDir, "notes.txt", []byte("not an image"))
+	// An icon is an image, but no decoder is registered for it.
+	createTestFile(t, tmpDir, "favicon.ico", []byte("\x00\x00\x01\x00\x01\x00\x10\x10"))
+
+	sink := &recordingSink{}
+	err := runVerify(tmpDir, sink)
+	messages := sink.messages()
+	if err != nil {
+		t.Fatalf("runVerify failed on valid images: %v. Messages: %v", err, messages)
+	}
+	if !findMessage(messages, "INFO: Verified 1 image files, 0 failed, 1 skipped as unsupported.") {
+		t.Errorf("Missing summary. Messages: %v", messages)
+	}
+
+	data, err := os.ReadFile(pngPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := createTestFile(t, tmpDir, "truncated.png", data[:len(data)/2])
+	sink = &recordingSink{}
+	err = runVerify(tmpDir, sink)
+	messages = sink.messages()
+	if err == nil {
+		t.Fatalf("runVerify accepted a truncated image. Messages: %v", messages)
+	}
+	if !findMessage(messages, "ERROR: "+truncated+" (image/png) failed to decode") {
+		t.Errorf("Missing error for the truncated image. Messages: %v", messages)
+	}
+}
+
+func TestInspectFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := createIntegrationTestImage(t, tmpDir, "image.jpg", "jpeg")
+
+	var out strings.Builder
+	log := newLogger(slog.LevelInfo, logFormatText, &out, &out)
+	var infos []imageinfo.Info
+	collect := func(info imageinfo.Info) { infos = append(infos, info) }
+	err := inspectFiles([]string{jpgPath}, log, collect)
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("inspectFiles returned %v, %v", infos, err)
+	}
+	lines := describeInfo(infos[0])
+	for _, want := range []string{"MIME type:    image/jpeg", "Format:       jpeg", "Colour model: YCbCr", "Alpha:        no", "Frames:       1"} {
+		if !findMessage(lines, want) {
+			t.Errorf("Missing %q. Lines: %v", want, lines)
+		}
+	}
+
+	missing := filepath.Join(tmpDir, "missing.png")
+	infos = nil
+	err = inspectFiles([]string{missing, jpgPath}, log, collect)
+	if err == nil || len(infos) != 1 {
+		t.Errorf("inspectFiles with a missing file returned %d infos, %v; expected 1 and an error", len(infos), err)
+	}
+	if !strings.Contains(out.String(), "ERROR: Error reading file "+missing) {
+		t.Errorf("The missing file was not logged. Output: %q", out.String())
+	}
+}
+
+func TestIntegration_Verify(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := createIntegrationTestImage(t, tmpDir, "photo.jpg", "jpeg")
+	pngPath := createIntegrationTestImage(t, tmpDir, "image.png", "png")
+
+	// PNG is lossless, so the output matches the decoded source exactly.
+	messages, err := recordRun(jpgPath, appOptions{Verify: true, VerifyPSNR: 20, Convert: converter.Options{Format: converter.FormatPNG}})
+	if err != nil {
+		t.Fatalf("runApp with --verify failed: %v. Messages: %v", err, messages)
+	}
+	output := filepath.Join(tmpDir, "photo.png")
+	if !findMessage(messages, "INFO: Verified "+output+" (") || !findMessage(messages, "PSNR +Inf dB") {
+		t.Errorf("Missing verification message. Messages: %v", messages)
+	}
+	checkFileExists(t, output)
+
+	// A lossy output that cannot reach the required PSNR is removed.
+	messages, err = recordRun(pngPath, appOptions{Verify: true, VerifyPSNR: 99, Convert: converter.Options{Format: converter.FormatJPEG, Quality: 1}})
+	if err != nil {
+		t.Fatalf("runApp with --verify-psnr failed: %v. Messages: %v", err, messages)
+	}
+	jpgOutput := filepath.Join(tmpDir, "image.jpg")
+	if !findMessage(messages, "ERROR: Output "+jpgOutput+" failed verification: PSNR") || !findMessage(messages, "removed it") {
+		t.Errorf("Missing verification failure. Messages: %v", messages)
+	}
+	checkFileDoesNotExist(t, jpgOutput)
+}
+
+func TestProgress(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := func() time.Time { return clock }
+
+	t.Run("log lines", func(t *testing.T) {
+		var out strings.Builder
+		p := &progress{log: newLogger(slog.LevelInfo, logFormatText, &out, &out), now: now}
+		p.begin(4)
+		clock = clock.Add(time.Second)
+		p.advance(1024) // Too soon for a log line.
+		clock = clock.Add(10 * time.Second)
+		p.advance(2048)
+		if want := "INFO: Progress: 2/4 files, 0.2 files/s, 3.0 KB saved, ETA 11s\n"; out.String() != want {
+			t.Errorf("Got %q, expected %q", out.String(), want)
+		}
+		p.advance(0)
+		p.advance(-512)
+		if summary := p.finish(); summary != "Processed 4 files in 11s (0.4 files/s), 2.5 KB saved" {
+			t.Errorf("Unexpected summary %q", summary)
+		}
+	})
+
+	t.Run("terminal", func(t *testing.T) {
+		var out strings.Builder
+		p := &progress{out: &out, tty: true, now: now}
+		p.begin(2)
+		clock = clock.Add(time.Second)
+		p.advance(100)
+		if !strings.HasSuffix(out.String(), "\r[###############...............] 1/2 files, 1.0 files/s, 100 B saved, ETA 1s") {
+			t.Errorf("Unexpected bar %q", out.String())
+		}
+		p.finish()
+		if !strings.HasSuffix(out.String(), "\r"+strings.Repeat(" ", len("[###############...............] 1/2 files, 1.0 files/s, 100 B saved, ETA 1s"))+"\r") {
+			t.Errorf("Bar was not cleared: %q", out.String())
+		}
+	})
+}
+
+func TestIntegration_ProgressSummary(t *testing.T) {
+	tmpDir := t.TempDir()
+	createIntegrationTestImage(t, tmpDir, "image.png", "png")
+	createTestFile(t, tmpDir, "notes.txt", []byte("not an image"))
+
+	var out strings.Builder
+	messages, err := recordRun(tmpDir, appOptions{Progress: &progress{out: &out, now: time.Now}})
+	if err != nil {
+		t.Fatalf("runApp failed: %v. Messages: %v", err, messages)
+	}
+	if !findMessage(messages, "INFO: Processed 2 files in ") {
+		t.Errorf("Missing progress summary. Messages: %v", messages)
+	}
+}
+
+func TestIntegration_Events(t *testing.T) {
+	tmpDir := t.TempDir()
+	pngPath := createIntegrationTestImage(t, tmpDir, "image.png", "png")
+	txtPath := createTestFile(t, tmpDir, "notes.txt", []byte("not an image"))
+
+	sink := &recordingSink{}
+	if err := runApp(tmpDir, appOptions{Events: sink}); err != nil {
+		t.Fatalf("runApp failed: %v. Messages: %v", err, sink.messages())
+	}
+	var got []string
+	for _, e := range sink.events {
+		if e.kind != eventInfo {
+			got = append(got, e.kind+" "+e.Action+" "+filepath.Base(e.Path))
+		}
+	}
+	want := []string{
+		"discovered  image.png",
+		"converted convert image.png",
+		"discovered  notes.txt",
+		"skipped skip-unsupported notes.txt",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Events are\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	converted := sink.events[len(sink.events)-3]
+	if converted.Output != strings.TrimSuffix(pngPath, ".png")+".webp" || converted.MIMEType != "image/png" ||
+		converted.Result == nil || converted.Result.OutputSize == 0 {
+		t.Errorf("Unexpected converted event %+v", converted.event)
+	}
+	if skipped := sink.events[len(sink.events)-1]; skipped.Path != txtPath || skipped.Planned {
+		t.Errorf("Unexpected skipped event %+v", skipped.event)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var out strings.Builder
+	sink := newJSONSink(&out)
+	sink.OnConverted(event{Path: "a.png", MIMEType: "image/png", Output: "a.webp", Action: "convert",
+		Result: &converter.Result{InputSize: 100, OutputSize: 40}, Message: "Successfully converted a.png"})
+	sink.OnError(event{Path: "b.gif", Action: "convert", Err: fmt.Errorf("bad data"), Message: "Failed to convert b.gif"})
+
+	want := `{"event":"converted","action":"convert","path":"a.png","mime_type":"image/png","output":"a.webp","input_size":100,"output_size":40,"message":"Successfully converted a.png"}
+{"event":"error","action":"convert","path":"b.gif","error":"bad data","message":"Failed to convert b.gif"}
+`
+	if out.String() != want {
+		t.Errorf("JSON output is\n%s\nexpected\n%s", out.String(), want)
+	}
+}
+
+func TestLogSink(t *testing.T) {
+	var stdout, stderr, bar strings.Builder
+	p := &progress{out: &bar, tty: true, now: time.Now}
+	sink := &logSink{log: newLogger(slog.LevelInfo, logFormatText, progressWriter{&stdout, p}, progressWriter{&stderr, p})}
+	p.begin(2)
+	sink.OnDiscovered(event{Path: "a.txt", MIMEType: "text/plain", Message: "File: a.txt, Detected MIME type: text/plain"})
+	sink.OnSkipped(event{Message: "Skipping file a.txt"})
+	sink.OnConverted(event{Planned: true, Message: "convert b.png -> b.webp"})
+	sink.OnError(event{Message: "Failed to convert b.png"})
+	p.finish()
+
+	if stdout.String() != "INFO: Skipping file a.txt\nPLAN: convert b.png -> b.webp\n" || stderr.String() != "ERROR: Failed to convert b.png\n" {
+		t.Errorf("Unexpected output %q and %q", stdout.String(), stderr.String())
+	}
+	// The bar is drawn by begin, then cleared and redrawn around each line.
+	if n := strings.Count(bar.String(), "0/2 files"); n != 4 {
+		t.Errorf("Bar drawn %d times, expected 4: %q", n, bar.String())
+	}
+
+	var out strings.Builder
+	sink = &logSink{log: newLogger(slog.LevelDebug, logFormatJSON, &out, &out), structured: true}
+	sink.OnDiscovered(event{Path: "a.png", MIMEType: "image/png", Message: "File: a.png"})
+	var record map[string]any
+	if err := json.Unmarshal([]byte(out.String()), &record); err != nil {
+		t.Fatalf("Invalid JSON log %q: %v", out.String(), err)
+	}
+	if record["level"] != "DEBUG" || record["msg"] != "File: a.png" || record["event"] != eventDiscovered ||
+		record["path"] != "a.png" || record["mime_type"] != "image/png" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestLineHandler(t *testing.T) {
+	var out strings.Builder
+	log := newLogger(slog.LevelWarn, logFormatText, &out, &out)
+	log.Info("Hidden")
+	log.With("file", "a b.png").WithGroup("size").Warn("Too large", "width", 10, slog.Group("limit", "bytes", 5))
+	log.Log(context.Background(), levelPlan, "Hidden too")
+	if want := "WARN: Too large file=\"a b.png\" size.width=10 size.limit.bytes=5\n"; out.String() != want {
+		t.Errorf("Got %q, expected %q", out.String(), want)
+	}
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("parseLogLevel accepted an unknown level")
+	}
+}
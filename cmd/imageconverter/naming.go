@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"imageconverter/internal/converter"
+)
+
+// namePlaceholders lists the placeholders accepted by --name-template.
+var namePlaceholders = []string{"name", "ext", "width", "height", "quality", "hash"}
+
+// nameTemplate builds output file names from --name-template. The zero
+// value names outputs after the source file with the output format's
+// extension, e.g. photo.jpg becomes photo.webp.
+type nameTemplate struct {
+	template string
+	// needsSize and needsHash record which placeholders need the source
+	// file to be read.
+	needsSize, needsHash bool
+	// needsQuality records a {quality} placeholder, which cannot be used
+	// with a target that chooses the quality per image.
+	needsQuality bool
+}
+
+// parseNameTemplate validates a --name-template value. Placeholders are
+// written as {name}; the result must be a plain file name.
+func parseNameTemplate(s string) (nameTemplate, error) {
+	if s == "" {
+		return nameTemplate{}, nil
+	}
+	if strings.ContainsAny(s, `/\`) {
+		return nameTemplate{}, fmt.Errorf("template %q must be a file name without directories", s)
+	}
+	t := nameTemplate{template: s}
+	for rest := s; rest != ""; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			break
+		}
+		if rest[open] == '}' {
+			return nameTemplate{}, fmt.Errorf("unmatched '}' in template %q", s)
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nameTemplate{}, fmt.Errorf("unclosed '{' in template %q", s)
+		}
+		name := rest[open+1 : open+end]
+		known := false
+		for _, p := range namePlaceholders {
+			known = known || p == name
+		}
+		if !known {
+			return nameTemplate{}, fmt.Errorf("unknown placeholder {%s} in template %q, expected one of {%s}", name, s, strings.Join(namePlaceholders, "}, {"))
+		}
+		t.needsSize = t.needsSize || name == "width" || name == "height"
+		t.needsHash = t.needsHash || name == "hash"
+		t.needsQuality = t.needsQuality || name == "quality"
+		rest = rest[open+end+1:]
+	}
+	return t, nil
+}
+
+// outputs returns the output paths for the source file fPath, one per page.
+// Multi-page outputs get a -page<N> suffix on {name}. It returns an error
+// if an output would be the source file itself, such as with a template of
+// "{name}.{ext}".
+func (t nameTemplate) outputs(fPath string, pages int, encoder converter.Encoder, convOpts converter.Options) ([]string, error) {
+	names, err := t.expand(fPath, pages, encoder, convOpts)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if samePath(name, fPath) {
+			return nil, fmt.Errorf("output %s would overwrite its own source", name)
+		}
+	}
+	return names, nil
+}
+
+// expand returns the output paths for fPath as outputs does, without
+// checking them.
+func (t nameTemplate) expand(fPath string, pages int, encoder converter.Encoder, convOpts converter.Options) ([]string, error) {
+	ext := filepath.Ext(fPath)
+	baseName := strings.TrimSuffix(filepath.Base(fPath), ext)
+	names := []string{baseName}
+	if pages > 1 {
+		names = names[:0]
+		for page := 0; page < pages; page++ {
+			names = append(names, fmt.Sprintf("%s-page%d", baseName, page+1))
+		}
+	}
+	if t.template == "" {
+		for i, name := range names {
+			names[i] = filepath.Join(filepath.Dir(fPath), name+encoder.Extension())
+		}
+		return names, nil
+	}
+
+	if t.needsQuality && hasTarget(convOpts) {
+		return nil, fmt.Errorf("name template %q uses {quality}, which is unknown before a target size or similarity picks the quality", t.template)
+	}
+	values := []string{
+		"{ext}", strings.TrimPrefix(ext, "."),
+		"{quality}", qualityLabel(convOpts),
+	}
+	if t.needsSize {
+		width, height, err := outputSize(fPath, convOpts)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, "{width}", strconv.Itoa(width), "{height}", strconv.Itoa(height))
+	}
+	if t.needsHash {
+		hash, err := fileHash(fPath)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, "{hash}", hash)
+	}
+	for i, name := range names {
+		expanded := strings.NewReplacer(append(values, "{name}", name)...).Replace(t.template)
+		if expanded == "" || expanded == "." || expanded == ".." {
+			return nil, fmt.Errorf("name template %q expands to the invalid file name %q", t.template, expanded)
+		}
+		names[i] = filepath.Join(filepath.Dir(fPath), expanded)
+	}
+	return names, nil
+}
+
+// samePath reports whether a and b name the same file: they have the same
+// cleaned absolute path or, if both exist, are the same file on disk, which
+// also catches case-insensitive file systems and links.
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA == nil && errB == nil && absA == absB {
+		return true
+	}
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// qualityLabel describes the configured quality for the {quality} placeholder.
+func qualityLabel(convOpts converter.Options) string {
+	switch {
+	case !converter.UsesQuality(convOpts):
+		return "lossless"
+	case convOpts.Auto:
+		return "auto"
+	case convOpts.Quality == 0:
+		return strconv.Itoa(converter.DefaultQuality)
+	}
+	return strconv.FormatFloat(float64(convOpts.Quality), 'g', -1, 32)
+}
+
+// hasTarget reports whether convOpts searches for the quality meeting a
+// target size or similarity.
+func hasTarget(convOpts converter.Options) bool {
+	return convOpts.TargetSize > 0 || convOpts.TargetSSIM > 0 || convOpts.TargetPSNR > 0
+}
+
+// outputSize returns the dimensions the source image will have after
+// --max-width and --max-height, reading only the image header.
+func outputSize(fPath string, convOpts converter.Options) (int, int, error) {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image size of %s: %w", fPath, err)
+	}
+	width, height := converter.FitSize(config.Width, config.Height, convOpts.MaxWidth, convOpts.MaxHeight)
+	return width, height, nil
+}
+
+// fileHash returns the first 8 hex digits of the SHA-256 of the file at fPath.
+func fileHash(fPath string) (string, error) {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", fPath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:8], nil
+}
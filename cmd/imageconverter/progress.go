@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Progress display settings.
+const (
+	progressBarWidth    = 30
+	progressRedraw      = 100 * time.Millisecond // Between redraws of the bar.
+	progressLogInterval = 10 * time.Second       // Between log lines off a terminal.
+)
+
+// progress reports how far a batch has got. On a terminal it redraws a
+// single status line with a bar on out; otherwise it logs a line every
+// progressLogInterval.
+type progress struct {
+	out   io.Writer
+	log   *slog.Logger
+	tty   bool
+	now   func() time.Time
+	total int
+	done  int
+	saved int64 // Bytes saved by the outputs written so far.
+	start time.Time
+	last  time.Time // When the status was last written.
+	width int       // Length of the status line on the terminal, to clear it.
+	// drawing is set between begin and finish on a terminal.
+	drawing bool
+}
+
+// newProgress returns a progress that draws a bar on f if f is a terminal,
+// and otherwise logs to log.
+func newProgress(f *os.File, log *slog.Logger) *progress {
+	info, err := f.Stat()
+	return &progress{out: f, log: log, tty: err == nil && info.Mode()&os.ModeCharDevice != 0, now: time.Now}
+}
+
+// begin starts reporting a batch of total files.
+func (p *progress) begin(total int) {
+	p.total, p.done, p.saved = total, 0, 0
+	p.start = p.now()
+	p.last = p.start
+	if p.tty {
+		p.drawing = true
+		p.draw()
+	}
+}
+
+// advance records that another file has been processed, saving saved bytes.
+func (p *progress) advance(saved int64) {
+	p.done++
+	p.saved += saved
+	now := p.now()
+	switch {
+	case p.tty && (now.Sub(p.last) >= progressRedraw || p.done == p.total):
+		p.last = now
+		p.draw()
+	case !p.tty && now.Sub(p.last) >= progressLogInterval && p.done < p.total:
+		p.last = now
+		p.log.Info("Progress: " + p.status())
+	}
+}
+
+// finish clears the bar and returns a summary of the batch.
+func (p *progress) finish() string {
+	if p.tty {
+		p.drawing = false
+		fmt.Fprintf(p.out, "\r%s\r", strings.Repeat(" ", p.width))
+		p.width = 0
+	}
+	elapsed := p.now().Sub(p.start)
+	return fmt.Sprintf("Processed %d files in %s (%.1f files/s), %s saved",
+		p.done, elapsed.Round(time.Millisecond), p.rate(), formatBytes(p.saved))
+}
+
+// hide clears the bar, if it is drawn, so that a line can be printed.
+func (p *progress) hide() {
+	if p.drawing && p.width > 0 {
+		fmt.Fprintf(p.out, "\r%s\r", strings.Repeat(" ", p.width))
+		p.width = 0
+	}
+}
+
+// show draws the bar again after hide.
+func (p *progress) show() {
+	if p.drawing {
+		p.draw()
+	}
+}
+
+// draw redraws the status line on the terminal.
+func (p *progress) draw() {
+	filled := progressBarWidth
+	if p.total > 0 {
+		filled = progressBarWidth * p.done / p.total
+	}
+	line := fmt.Sprintf("[%s%s] %s", strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), p.status())
+	pad := ""
+	if len(line) < p.width {
+		pad = strings.Repeat(" ", p.width-len(line))
+	}
+	p.width = len(line)
+	fmt.Fprintf(p.out, "\r%s%s", line, pad)
+}
+
+// status describes the progress so far.
+func (p *progress) status() string {
+	s := fmt.Sprintf("%d/%d files, %.1f files/s, %s saved", p.done, p.total, p.rate(), formatBytes(p.saved))
+	if p.done > 0 && p.done < p.total {
+		elapsed := p.now().Sub(p.start)
+		eta := time.Duration(float64(elapsed) / float64(p.done) * float64(p.total-p.done))
+		s += ", ETA " + eta.Round(time.Second).String()
+	}
+	return s
+}
+
+// rate returns the files processed per second so far.
+func (p *progress) rate() float64 {
+	elapsed := p.now().Sub(p.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.done) / elapsed
+}
+
+// formatBytes formats a byte count with a binary unit, as accepted by
+// --target-size.
+func formatBytes(n int64) string {
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%s%.1f GB", sign, float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%s%.1f MB", sign, float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%s%.1f KB", sign, float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%s%d B", sign, n)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"imageconverter/internal/config"
+	"imageconverter/internal/converter"
+	"imageconverter/internal/proxy"
+)
+
+// runProxy runs the "proxy" subcommand, which serves a directory and
+// converts JPEG and PNG files to WebP for clients that accept it.
+func runProxy(args []string) error {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	dir := flags.String("dir", "", "Directory to serve (required)")
+	cacheDir := flags.String("cache-dir", "", "Directory for converted images (default: imageconverter in the user cache directory)")
+	addr := flags.String("addr", ":8080", "Address to listen on")
+	configPath := flags.String("config", "", "Configuration file with per-glob settings (default: "+config.FileName+" in --dir, if present)")
+	logging := addLogFlags(flags)
+	// Flags given explicitly take precedence over the configuration file.
+	var overrides config.Settings
+	for _, setting := range []struct{ name, usage string }{
+		{"quality", "Lossy WebP quality (1-100)"},
+		{"mode", "WebP encoding mode: 'lossy', 'lossless' or 'auto'"},
+		{"alpha-quality", "Lossy WebP alpha channel quality (1-100)"},
+		{"exact", "Keep the RGB values of fully transparent pixels: 'true' or 'false' (lossless only)"},
+		{"flatten", "Composite transparent images onto this background colour, e.g. '#ffffff'"},
+		{"to-srgb", "Convert images with an RGB matrix/TRC ICC profile to sRGB: 'true' or 'false'"},
+		{"max-width", "Downscale images wider than this many pixels"},
+		{"max-height", "Downscale images taller than this many pixels"},
+		{"target-size", "Largest output size per image, e.g. '100KB'"},
+		{"target-ssim", "Use the lowest quality whose output reaches this SSIM"},
+		{"target-psnr", "Use the lowest quality whose output reaches this PSNR in dB"},
+		{"encoder", "WebP encoder backend"},
+	} {
+		flags.Func(setting.name, setting.usage, func(value string) error {
+			return overrides.Set(setting.name, value)
+		})
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s proxy --dir DIR [flags]\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Serves the files in DIR. JPEG and PNG images are converted to WebP, and cached, for clients whose Accept header includes image/webp.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *dir == "" {
+		return errors.New("--dir is required")
+	}
+	if err := overrides.Validate(); err != nil {
+		return err
+	}
+	log, err := logging.logger()
+	if err != nil {
+		return err
+	}
+	if *cacheDir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return fmt.Errorf("no --cache-dir given and no user cache directory: %w", err)
+		}
+		*cacheDir = filepath.Join(userCache, "imageconverter")
+	}
+	var cfg *config.Config
+	if *configPath != "" {
+		cfg, err = config.Load(*configPath)
+	} else {
+		cfg, err = config.Find(*dir)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid configuration file: %w", err)
+	}
+
+	handler, err := proxy.New(proxy.Config{
+		Root:     *dir,
+		CacheDir: *cacheDir,
+		Options: func(fPath string) converter.Options {
+			var opts converter.Options
+			if cfg != nil {
+				cfg.Resolve(fPath).Apply(&opts)
+			}
+			overrides.Apply(&opts)
+			return opts
+		},
+		OnError: func(fPath string, err error) {
+			log.Error(fmt.Sprintf("Failed to convert %s, serving the original: %v", fPath, err))
+		},
+	})
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: *addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	log.Info(fmt.Sprintf("Serving %s on %s (cache: %s)", *dir, *addr, *cacheDir))
+	return listenAndServe(srv)
+}
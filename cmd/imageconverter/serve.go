@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"time"
+
+	"imageconverter/internal/config"
+	"imageconverter/internal/converter"
+	"imageconverter/internal/server"
+)
+
+// runServe runs the "serve" subcommand, which serves conversions over HTTP
+// until interrupted.
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "Address to listen on")
+	maxBodySize := flags.String("max-body-size", "32MB", "Largest accepted upload, e.g. '10MB'")
+	maxConcurrent := flags.Int("max-concurrent", runtime.NumCPU(), "Conversions allowed to run at once; further requests get 503")
+	maxPixels := flags.Int64("max-pixels", server.DefaultMaxPixels, "Largest accepted image in pixels (width times height); larger images get 413 before they are decoded")
+	encoderName := flags.String("encoder", converter.DefaultWebPEncoder(), "Default WebP encoder backend (available: "+strings.Join(converter.WebPEncoderNames(), ", ")+")")
+	logging := addLogFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s serve [flags]\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Serves POST /convert, GET /healthz and GET /metrics. Conversion options are passed as query parameters, e.g. /convert?quality=70&max-width=1024&to=webp.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	bodySize, err := config.ParseByteSize(*maxBodySize)
+	if err != nil {
+		return fmt.Errorf("invalid --max-body-size: %w", err)
+	}
+	if *maxConcurrent < 1 {
+		return errors.New("--max-concurrent must be at least 1")
+	}
+	if *maxPixels < 1 {
+		return errors.New("--max-pixels must be at least 1")
+	}
+	if _, err := converter.WebPEncoder(*encoderName); err != nil {
+		return err
+	}
+	log, err := logging.logger()
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr: *addr,
+		Handler: server.New(server.Config{
+			MaxBodySize:   bodySize,
+			MaxConcurrent: *maxConcurrent,
+			MaxPixels:     *maxPixels,
+			Options:       converter.Options{Encoder: *encoderName},
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Info(fmt.Sprintf("Listening on %s (max body size %d bytes, %d concurrent conversions)", *addr, bodySize, *maxConcurrent))
+	return listenAndServe(srv)
+}
+
+// listenAndServe runs srv until it fails or the process is interrupted, in
+// which case running requests are given time to finish.
+func listenAndServe(srv *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-shutdown
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"strings"
+
+	"imageconverter/internal/filesystem"
+)
+
+// runVerifyCommand runs the "verify" subcommand.
+func runVerifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	logging := addLogFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify [flags] PATH\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Decodes every image file under PATH and reports the ones that are truncated or corrupt.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected exactly one path")
+	}
+	log, err := logging.logger()
+	if err != nil {
+		return err
+	}
+
+	return runVerify(flags.Arg(0), &logSink{log: log, structured: *logging.format == logFormatJSON})
+}
+
+// runVerify decodes every image file found under inputPath, reporting each
+// of them to events. It returns an error if any of them fails to decode.
+func runVerify(inputPath string, events eventSink) error {
+	files, err := filesystem.FindFiles(inputPath)
+	if err != nil {
+		return fmt.Errorf("error finding files: %w", err)
+	}
+	checked, failed, unsupported := 0, 0, 0
+	for _, fPath := range files {
+		mimeType, err := sniffFile(fPath)
+		if err != nil {
+			events.OnError(event{Path: fPath, Err: err, Message: fmt.Sprintf("Error %v. Skipping.", err)})
+			failed++
+			continue
+		}
+		if !strings.HasPrefix(mimeType, "image/") {
+			continue
+		}
+		e := event{Path: fPath, MIMEType: mimeType, Action: "verify"}
+		data, err := os.ReadFile(fPath)
+		if err == nil {
+			var img image.Image
+			if img, _, err = image.Decode(bytes.NewReader(data)); err == nil {
+				checked++
+				b := img.Bounds()
+				e.Message = fmt.Sprintf("OK %s (%s, %dx%d)", fPath, mimeType, b.Dx(), b.Dy())
+				events.OnInfo(e)
+				continue
+			}
+			if errors.Is(err, image.ErrFormat) {
+				// No decoder is registered for this format, e.g. ICO or AVIF.
+				unsupported++
+				e.Action = "skip-unsupported"
+				e.Message = fmt.Sprintf("Skipping file %s (detected MIME type: %s, not a supported image format).", fPath, mimeType)
+				events.OnSkipped(e)
+				continue
+			}
+		}
+		checked++
+		e.Err = err
+		e.Message = fmt.Sprintf("%s (%s) failed to decode: %v", fPath, mimeType, err)
+		events.OnError(e)
+		failed++
+	}
+	events.OnInfo(event{Message: fmt.Sprintf("Verified %d image files, %d failed, %d skipped as unsupported.", checked, failed, unsupported)})
+	if failed > 0 {
+		return fmt.Errorf("%d of %d image files failed verification", failed, checked)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"imageconverter/internal/converter"
+	"imageconverter/internal/watcher"
+)
+
+// runWatch converts everything under root like runApp, then keeps running
+// and converts files that are created or modified until interrupted. Files
+// written by the converter itself, hidden files (which include its
+// temporary files) and originals moved by --after are ignored.
+func runWatch(root string, opts appOptions, watchOpts watcher.Options) error {
+	opts.Root = root
+	session, err := newWatchSession(root, opts)
+	if err != nil {
+		return err
+	}
+	// The sources converted, or skipped, by the initial pass are recorded
+	// along with their outputs, so that later changes to them are converted
+	// over those outputs and checked against the other sources.
+	initial := session.opts
+	initial.OnJobs = session.add
+	if err := runApp(root, initial); err != nil {
+		return err
+	}
+	session.opts.Progress = nil // Files are converted one at a time from here on.
+
+	moveDir := ""
+	if opts.After.Kind == afterMove {
+		moveDir, _ = filepath.Abs(opts.After.Dir)
+	}
+	watchOpts.Ignore = func(path string) bool {
+		if session.written[pathKey(path)] || strings.HasPrefix(filepath.Base(path), ".") {
+			return true
+		}
+		if moveDir != "" {
+			if abs, err := filepath.Abs(path); err == nil && (abs == moveDir || strings.HasPrefix(abs, moveDir+string(filepath.Separator))) {
+				return true
+			}
+		}
+		return false
+	}
+
+	w, err := watcher.New(root, watchOpts)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", root, err)
+	}
+	how := "file system notifications"
+	if w.Polling() {
+		how = "polling"
+	}
+	opts.Events.OnInfo(event{Path: root, Message: fmt.Sprintf("Watching %s for new images using %s (press Ctrl+C to stop)", root, how)})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return w.Run(ctx, session.convert)
+}
+
+// watchSession converts the files the watcher reports, one at a time. Its
+// maps are keyed by pathKey and only touched from one goroutine: the
+// initial pass runs before the watcher starts, and the watcher calls back
+// synchronously.
+type watchSession struct {
+	root    string
+	encoder converter.Encoder
+	opts    appOptions
+	sources map[string]job      // Sources converted, or skipped, before.
+	owners  map[string][]string // The sources each output belongs to.
+	written map[string]bool     // Outputs written other than over their source.
+}
+
+// newWatchSession returns a watchSession for the files below root.
+func newWatchSession(root string, opts appOptions) (*watchSession, error) {
+	encoder, err := converter.EncoderFor(opts.Convert.Format)
+	if err != nil {
+		return nil, err
+	}
+	s := &watchSession{
+		root:    root,
+		encoder: encoder,
+		sources: make(map[string]job),
+		owners:  make(map[string][]string),
+		written: make(map[string]bool),
+	}
+	// Re-encoded WebP files are written over their source, and are not
+	// ignored, so that later edits to them are still picked up.
+	onOutput := opts.OnOutput
+	opts.OnOutput = func(source, output string) {
+		if pathKey(output) != pathKey(source) {
+			s.written[pathKey(output)] = true
+		}
+		if onOutput != nil {
+			onOutput(source, output)
+		}
+	}
+	s.opts = opts
+	return s, nil
+}
+
+// add records jobs as known sources, along with the outputs they write.
+func (s *watchSession) add(jobs []job) {
+	for _, j := range jobs {
+		source := pathKey(j.path)
+		s.sources[source] = j
+		for _, output := range j.outputs {
+			key := pathKey(output)
+			if key != source && !slices.Contains(s.owners[key], source) {
+				s.owners[key] = append(s.owners[key], source)
+			}
+		}
+	}
+}
+
+// convert processes the created or modified file at path like runApp, but
+// without repeating the run's settings. A source seen before has changed
+// since its outputs were written, so they are overwritten.
+func (s *watchSession) convert(path string) {
+	path = filepath.Clean(path)
+	opts := s.opts
+	_, seen := s.sources[pathKey(path)]
+	opts.Force = opts.Force || seen
+
+	j, ok := newJob(path, s.encoder, opts)
+	if !ok {
+		return
+	}
+	s.detectCollisions(&j, opts.Force)
+	s.add([]job{j})
+	runJob(j, s.encoder, s.root, opts)
+}
+
+// detectCollisions marks j if one of its outputs belongs to another source
+// the session knows about, or would overwrite one, as detectCollisions does
+// within a batch.
+func (s *watchSession) detectCollisions(j *job, force bool) {
+	if j.err != nil {
+		return
+	}
+	source := pathKey(j.path)
+	for _, output := range j.outputs {
+		key := pathKey(output)
+		for _, owner := range s.owners[key] {
+			if owner != source {
+				j.err = fmt.Errorf("output %s collides with the output of %s; use --name-template to disambiguate", output, owner)
+				return
+			}
+		}
+		if other, ok := s.sources[key]; ok && key != source && force && !replaceable(other, s.encoder) {
+			j.err = fmt.Errorf("output %s would overwrite the source file %s; use --name-template to disambiguate", output, other.path)
+			return
+		}
+	}
+}
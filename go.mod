@@ -7,3 +7,10 @@ toolchain go1.23.9
 require golang.org/x/image v0.27.0
 
 require github.com/chai2010/webp v1.4.0
+
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.13.0 // indirect
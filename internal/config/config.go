@@ -0,0 +1,426 @@
+// Package config loads .webpconv.yaml files, which set conversion options
+// for a directory tree with per-glob rules.
+//
+// A file sets defaults at the top level and lists rules under "rules". Each
+// rule maps a glob to settings, given either as a mapping or as a shorthand
+// string of comma-separated "key value" pairs, where a bare key means true:
+//
+//	quality: 80
+//	rules:
+//	  icons/**: lossless
+//	  photos/**: quality 70, max-width 2048
+//	  "*.gif":
+//	    mode: auto
+//
+// Rules are applied in the order they are written, so later matches
+// override earlier ones.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"imageconverter/internal/converter"
+)
+
+// FileName is the name of the configuration file looked up in the input directory.
+const FileName = ".webpconv.yaml"
+
+// Encoding modes accepted by the "mode" setting.
+const (
+	ModeLossy    = "lossy"
+	ModeLossless = "lossless"
+	ModeAuto     = "auto" // Encode both and keep the smaller result.
+)
+
+// Settings holds conversion options. Nil fields are unset and leave the
+// corresponding option unchanged.
+type Settings struct {
+	Quality    *float64
+	Mode       *string
+	MaxWidth   *int
+	MaxHeight  *int
+	TargetSize *int64
+	TargetSSIM *float64
+	TargetPSNR *float64
+	Encoder    *string
+	// AlphaQuality, Exact and Flatten control the alpha channel, see the
+	// converter.Options fields of the same meaning.
+	AlphaQuality *float64
+	Exact        *bool
+	Flatten      *color.NRGBA
+	ToSRGB       *bool
+}
+
+// Apply copies the set fields of s onto opts.
+func (s Settings) Apply(opts *converter.Options) {
+	if s.Quality != nil {
+		opts.Quality = float32(*s.Quality)
+	}
+	if s.Mode != nil {
+		opts.Lossless = *s.Mode == ModeLossless
+		opts.Auto = *s.Mode == ModeAuto
+	}
+	if s.MaxWidth != nil {
+		opts.MaxWidth = *s.MaxWidth
+	}
+	if s.MaxHeight != nil {
+		opts.MaxHeight = *s.MaxHeight
+	}
+	// The targets are mutually exclusive, so setting one clears the others.
+	if s.TargetSize != nil {
+		opts.TargetSize, opts.TargetSSIM, opts.TargetPSNR = *s.TargetSize, 0, 0
+	}
+	if s.TargetSSIM != nil {
+		opts.TargetSize, opts.TargetSSIM, opts.TargetPSNR = 0, *s.TargetSSIM, 0
+	}
+	if s.TargetPSNR != nil {
+		opts.TargetSize, opts.TargetSSIM, opts.TargetPSNR = 0, 0, *s.TargetPSNR
+	}
+	if s.Encoder != nil {
+		opts.Encoder = *s.Encoder
+	}
+	if s.AlphaQuality != nil {
+		opts.AlphaQuality = float32(*s.AlphaQuality)
+	}
+	if s.Exact != nil {
+		opts.Exact = *s.Exact
+	}
+	if s.Flatten != nil {
+		opts.Background = *s.Flatten
+	}
+	if s.ToSRGB != nil {
+		opts.ToSRGB = *s.ToSRGB
+	}
+}
+
+// Validate reports an error if s sets more than one of the mutually
+// exclusive targets, following converter.Options.Validate.
+func (s Settings) Validate() error {
+	var opts converter.Options
+	if s.TargetSize != nil {
+		opts.TargetSize = *s.TargetSize
+	}
+	if s.TargetSSIM != nil {
+		opts.TargetSSIM = *s.TargetSSIM
+	}
+	if s.TargetPSNR != nil {
+		opts.TargetPSNR = *s.TargetPSNR
+	}
+	return opts.Validate()
+}
+
+// Rule applies Settings to the files matching Glob.
+type Rule struct {
+	Glob     string
+	Settings Settings
+}
+
+// Config is a parsed configuration file.
+type Config struct {
+	// Dir is the directory the file was loaded from. Globs are matched
+	// against paths relative to it.
+	Dir      string
+	Defaults Settings
+	Rules    []Rule
+}
+
+// Find loads the configuration file for inputPath: FileName in inputPath if
+// it is a directory, or next to it if it is a file. It returns nil without
+// an error if there is no such file.
+func Find(inputPath string) (*Config, error) {
+	dir := inputPath
+	if info, err := os.Stat(inputPath); err == nil && !info.IsDir() {
+		dir = filepath.Dir(inputPath)
+	}
+	cfg, err := Load(filepath.Join(dir, FileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return cfg, err
+}
+
+// Load reads and parses the configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.Dir = filepath.Dir(path)
+	return cfg, nil
+}
+
+// Parse parses the contents of a configuration file.
+func Parse(data []byte) (*Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if len(doc.Content) == 0 {
+		return cfg, nil // Empty file.
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of settings", root.Line)
+	}
+
+	defaults := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if key.Value != "rules" {
+			defaults.Content = append(defaults.Content, key, value)
+			continue
+		}
+		if value.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("line %d: rules must be a mapping of globs to settings", value.Line)
+		}
+		// Walking the node keeps the rules in the order they are written.
+		for j := 0; j < len(value.Content); j += 2 {
+			glob, body := value.Content[j], value.Content[j+1]
+			if err := checkGlob(glob.Value); err != nil {
+				return nil, fmt.Errorf("line %d: %w", glob.Line, err)
+			}
+			settings, err := parseSettings(body)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", glob.Value, err)
+			}
+			cfg.Rules = append(cfg.Rules, Rule{Glob: glob.Value, Settings: settings})
+		}
+	}
+	var err error
+	if cfg.Defaults, err = parseSettings(defaults); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Resolve returns the settings for the file at fPath: the defaults with
+// every matching rule applied in order.
+func (c *Config) Resolve(fPath string) Settings {
+	resolved := c.Defaults
+	rel, err := filepath.Rel(c.Dir, fPath)
+	if err != nil {
+		return resolved
+	}
+	rel = filepath.ToSlash(rel)
+	for _, rule := range c.Rules {
+		if MatchGlob(rule.Glob, rel) {
+			resolved = resolved.merge(rule.Settings)
+		}
+	}
+	return resolved
+}
+
+// merge returns s with the set fields of other applied on top.
+func (s Settings) merge(other Settings) Settings {
+	if other.Quality != nil {
+		s.Quality = other.Quality
+	}
+	if other.Mode != nil {
+		s.Mode = other.Mode
+	}
+	if other.MaxWidth != nil {
+		s.MaxWidth = other.MaxWidth
+	}
+	if other.MaxHeight != nil {
+		s.MaxHeight = other.MaxHeight
+	}
+	if other.TargetSize != nil || other.TargetSSIM != nil || other.TargetPSNR != nil {
+		s.TargetSize, s.TargetSSIM, s.TargetPSNR = other.TargetSize, other.TargetSSIM, other.TargetPSNR
+	}
+	if other.Encoder != nil {
+		s.Encoder = other.Encoder
+	}
+	if other.AlphaQuality != nil {
+		s.AlphaQuality = other.AlphaQuality
+	}
+	if other.Exact != nil {
+		s.Exact = other.Exact
+	}
+	if other.Flatten != nil {
+		s.Flatten = other.Flatten
+	}
+	if other.ToSRGB != nil {
+		s.ToSRGB = other.ToSRGB
+	}
+	return s
+}
+
+// parseSettings parses a mapping of settings or a shorthand string.
+func parseSettings(node *yaml.Node) (Settings, error) {
+	var pairs [][2]string
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			pairs = append(pairs, [2]string{node.Content[i].Value, node.Content[i+1].Value})
+		}
+	case yaml.ScalarNode:
+		for _, part := range strings.Split(node.Value, ",") {
+			fields := strings.Fields(part)
+			switch len(fields) {
+			case 0:
+				continue
+			case 1:
+				pairs = append(pairs, [2]string{fields[0], "true"})
+			case 2:
+				pairs = append(pairs, [2]string{fields[0], fields[1]})
+			default:
+				return Settings{}, fmt.Errorf("line %d: expected \"key value\", got %q", node.Line, strings.TrimSpace(part))
+			}
+		}
+	default:
+		return Settings{}, fmt.Errorf("line %d: expected a mapping or a shorthand string", node.Line)
+	}
+
+	var s Settings
+	for _, pair := range pairs {
+		if err := s.Set(pair[0], pair[1]); err != nil {
+			return Settings{}, fmt.Errorf("line %d: %w", node.Line, err)
+		}
+	}
+	if err := s.Validate(); err != nil {
+		return Settings{}, fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return s, nil
+}
+
+// Set parses value and assigns it to the setting named key, using the keys
+// and value syntax of configuration files.
+func (s *Settings) Set(key, value string) error {
+	switch key {
+	case "quality":
+		q, err := strconv.ParseFloat(value, 64)
+		if err != nil || q < 1 || q > 100 {
+			return fmt.Errorf("quality must be a number between 1 and 100, got %q", value)
+		}
+		s.Quality = &q
+	case "lossless", "lossy", "auto":
+		// Shorthand for the mode, e.g. "icons/**: lossless".
+		if b, err := strconv.ParseBool(value); err != nil || !b {
+			return fmt.Errorf("%s can only be set to true, got %q", key, value)
+		}
+		s.Mode = &key
+	case "mode":
+		if value != ModeLossy && value != ModeLossless && value != ModeAuto {
+			return fmt.Errorf("mode must be lossy, lossless or auto, got %q", value)
+		}
+		s.Mode = &value
+	case "max-width", "max-height":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s must be a non-negative integer, got %q", key, value)
+		}
+		if key == "max-width" {
+			s.MaxWidth = &n
+		} else {
+			s.MaxHeight = &n
+		}
+	case "target-size":
+		size, err := ParseByteSize(value)
+		if err != nil {
+			return fmt.Errorf("target-size: %w", err)
+		}
+		s.TargetSize = &size
+	case "target-ssim":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v <= 0 || v > 1 {
+			return fmt.Errorf("target-ssim must be a number between 0 and 1, got %q", value)
+		}
+		s.TargetSSIM = &v
+	case "target-psnr":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("target-psnr must be a positive number, got %q", value)
+		}
+		s.TargetPSNR = &v
+	case "encoder":
+		if _, err := converter.WebPEncoder(value); err != nil {
+			return err
+		}
+		s.Encoder = &value
+	case "alpha-quality":
+		q, err := strconv.ParseFloat(value, 64)
+		if err != nil || q < 1 || q > 100 {
+			return fmt.Errorf("alpha-quality must be a number between 1 and 100, got %q", value)
+		}
+		s.AlphaQuality = &q
+	case "exact":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("exact must be true or false, got %q", value)
+		}
+		s.Exact = &b
+	case "flatten":
+		c, err := ParseColor(value)
+		if err != nil {
+			return fmt.Errorf("flatten: %w", err)
+		}
+		s.Flatten = &c
+	case "to-srgb":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("to-srgb must be true or false, got %q", value)
+		}
+		s.ToSRGB = &b
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+// checkGlob reports whether glob is a valid pattern for MatchGlob.
+func checkGlob(glob string) error {
+	for _, segment := range strings.Split(glob, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+	}
+	return nil
+}
+
+// MatchGlob reports whether the slash-separated relative path name matches
+// glob. Segments are matched with path.Match, and a "**" segment matches
+// any number of directories. A glob without a slash matches the base name
+// at any depth, so "*.png" matches every PNG file.
+func MatchGlob(glob, name string) bool {
+	if !strings.Contains(glob, "/") {
+		ok, _ := path.Match(glob, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments matches path segments against glob segments.
+func matchSegments(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for skip := 0; skip <= len(name); skip++ {
+				if matchSegments(glob[1:], name[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
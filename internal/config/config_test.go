@@ -0,0 +1,175 @@
+package config_test
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"imageconverter/internal/config"
+	"imageconverter/internal/converter"
+)
+
+func TestParse_RulesInOrder(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+quality: 85
+rules:
+  icons/**: lossless
+  photos/**: quality 70, max-width 2048
+  photos/thumbs/*:
+    max-width: 200
+    target-size: 20KB
+  "*.gif": mode auto
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	cfg.Dir = "/root"
+
+	var globs []string
+	for _, rule := range cfg.Rules {
+		globs = append(globs, rule.Glob)
+	}
+	if want := []string{"icons/**", "photos/**", "photos/thumbs/*", "*.gif"}; len(globs) != len(want) || globs[0] != want[0] || globs[3] != want[3] {
+		t.Fatalf("Expected rules %v in file order, got %v", want, globs)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want converter.Options
+	}{
+		{"/root/readme.png", converter.Options{Quality: 85}},
+		{"/root/icons/ui/close.png", converter.Options{Quality: 85, Lossless: true}},
+		{"/root/photos/2024/beach.jpg", converter.Options{Quality: 70, MaxWidth: 2048}},
+		{"/root/photos/thumbs/beach.jpg", converter.Options{Quality: 70, MaxWidth: 200, TargetSize: 20 * 1024}},
+		{"/root/photos/anim.gif", converter.Options{Quality: 70, MaxWidth: 2048, Auto: true}},
+	} {
+		var got converter.Options
+		cfg.Resolve(tc.path).Apply(&got)
+		if got != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for name, doc := range map[string]string{
+		"unknown setting":  "colour: red",
+		"bad quality":      "quality: 300",
+		"bad shorthand":    "rules:\n  a/**: quality 70 80",
+		"rules not a map":  "rules: [a, b]",
+		"bad glob":         "rules:\n  \"[a\": lossless",
+		"several targets":  "target-size: 10KB\ntarget-ssim: 0.9",
+		"unknown encoder":  "encoder: nope",
+		"not a mapping":    "- quality",
+		"lossless = false": "lossless: false",
+		"bad alpha":        "alpha-quality: 0",
+		"unquoted colour":  "flatten: #ffffff",
+	} {
+		if _, err := config.Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: expected an error for %q", name, doc)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		glob, name string
+		want       bool
+	}{
+		{"icons/**", "icons/a.png", true},
+		{"icons/**", "icons/sub/dir/a.png", true},
+		{"icons/**", "other/icons/a.png", false},
+		{"**/icons/*.png", "a/b/icons/x.png", true},
+		{"**/icons/*.png", "icons/x.png", true},
+		{"*.png", "deep/dir/x.png", true},
+		{"*.png", "x.jpg", false},
+		{"photos/*", "photos/a/b.jpg", false},
+	} {
+		if got := config.MatchGlob(tc.glob, tc.name); got != tc.want {
+			t.Errorf("MatchGlob(%q, %q) = %t, expected %t", tc.glob, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir := t.TempDir()
+	if cfg, err := config.Find(dir); err != nil || cfg != nil {
+		t.Fatalf("Expected no config in an empty directory, got %v, %v", cfg, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, config.FileName), []byte("quality: 60\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	imagePath := filepath.Join(dir, "image.png")
+	if err := os.WriteFile(imagePath, nil, 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+	cfg, err := config.Find(imagePath)
+	if err != nil || cfg == nil || cfg.Dir != dir {
+		t.Fatalf("Expected the config next to a file to be found, got %+v, %v", cfg, err)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for input, want := range map[string]int64{
+		"100KB": 100 * 1024,
+		"1.5mb": 1536 * 1024,
+		"2048":  2048,
+		"10 B":  10,
+	} {
+		got, err := config.ParseByteSize(input)
+		if err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; expected %d", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"", "KB", "10XB", "0", "-5KB"} {
+		if _, err := config.ParseByteSize(input); err == nil {
+			t.Errorf("Expected an error for ParseByteSize(%q)", input)
+		}
+	}
+}
+
+func TestParse_AlphaSettings(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+alpha-quality: 50
+rules:
+  logos/**: lossless, exact
+  photos/**: to-srgb
+  photos/**: "flatten #fff"
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	cfg.Dir = "/root"
+	for _, tc := range []struct {
+		path string
+		want converter.Options
+	}{
+		{"/root/logos/a.png", converter.Options{AlphaQuality: 50, Lossless: true, Exact: true}},
+		{"/root/photos/b.png", converter.Options{AlphaQuality: 50, ToSRGB: true, Background: color.NRGBA{R: 255, G: 255, B: 255, A: 255}}},
+	} {
+		var got converter.Options
+		cfg.Resolve(tc.path).Apply(&got)
+		if got != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	for input, want := range map[string]color.NRGBA{
+		"#ffffff": {R: 255, G: 255, B: 255, A: 255},
+		"#F80":    {R: 0xff, G: 0x88, B: 0, A: 255},
+		"102030":  {R: 0x10, G: 0x20, B: 0x30, A: 255},
+	} {
+		got, err := config.ParseColor(input)
+		if err != nil || got != want {
+			t.Errorf("ParseColor(%q) = %v, %v; expected %v", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"", "#ff", "white", "#fffffff", "#-12345"} {
+		if _, err := config.ParseColor(input); err == nil {
+			t.Errorf("Expected an error for ParseColor(%q)", input)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSizeUnits maps the unit suffixes accepted by ParseByteSize to their size in bytes.
+var byteSizeUnits = map[string]float64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+}
+
+// ParseByteSize parses a size such as "100KB", "1.5MB" or "2048". Units are
+// case-insensitive and binary, so 1KB is 1024 bytes.
+func ParseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	split := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if split < 0 {
+		split = len(s)
+	}
+	number, unit := s[:split], strings.TrimSpace(s[split:])
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q, expected B, KB, MB or GB", unit)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	size := int64(value * multiplier)
+	if size <= 0 {
+		return 0, fmt.Errorf("size %q must be positive", s)
+	}
+	return size, nil
+}
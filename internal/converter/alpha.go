@@ -0,0 +1,74 @@
+package converter
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Opaque reports whether every pixel of img is fully opaque.
+func Opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toNRGBA returns img with non-premultiplied alpha. NRGBA images are
+// returned unchanged, so the colour of fully transparent pixels is kept.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok {
+		return n
+	}
+	b := img.Bounds()
+	n := image.NewNRGBA(b)
+	draw.Draw(n, b, img, b.Min, draw.Src)
+	return n
+}
+
+// flatten composites img onto a solid background colour.
+func flatten(img image.Image, background color.Color) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Over)
+	return dst
+}
+
+// alphaLevels returns how many alpha levels are kept at the given alpha
+// quality, following libwebp's -alpha_q: 2 to 16 levels up to 70, then 8
+// more per step, so that 100 keeps all 256.
+func alphaLevels(quality float32) int {
+	q := int(quality)
+	if q <= 70 {
+		return 2 + q/5
+	}
+	return min(256, 16+(q-70)*8)
+}
+
+// quantizeAlpha reduces the alpha channel of img to the number of evenly
+// spaced levels alphaLevels allows at quality, which makes it compress
+// better. Fully transparent and fully opaque pixels are unchanged.
+func quantizeAlpha(img image.Image, quality float32) image.Image {
+	levels := alphaLevels(quality)
+	if levels >= 256 || Opaque(img) {
+		return img
+	}
+	src := toNRGBA(img)
+	dst := image.NewNRGBA(src.Rect)
+	copy(dst.Pix, src.Pix)
+	steps := levels - 1
+	for i := 3; i < len(dst.Pix); i += 4 {
+		level := (int(dst.Pix[i])*steps + 127) / 255
+		dst.Pix[i] = uint8((level*255 + steps/2) / steps)
+	}
+	return dst
+}
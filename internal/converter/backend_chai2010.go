@@ -0,0 +1,58 @@
+//go:build cgo
+
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// cgoWebPEncoders returns the WebP encoder backends that need cgo.
+func cgoWebPEncoders() map[string]Encoder {
+	return map[string]Encoder{EncoderChai2010: chai2010Encoder{}}
+}
+
+// chai2010Encoder encodes lossy or lossless WebP with libwebp through
+// github.com/chai2010/webp.
+type chai2010Encoder struct{}
+
+func (chai2010Encoder) Encode(w io.Writer, img image.Image, opts Options) error {
+	if opts.Exact && !opts.Lossless {
+		return errors.New("chai2010: exact mode needs lossless encoding")
+	}
+	switch {
+	case isGray(img):
+	case Opaque(img):
+		// Without an alpha channel no alpha data is written.
+		img = webp.NewRGBImageFrom(img)
+	default:
+		// libwebp expects non-premultiplied alpha, but chai2010/webp passes it
+		// the premultiplied pixels of an *image.RGBA, which darkens
+		// semi-transparent colours. Hand it non-premultiplied pixels in an
+		// *image.RGBA instead, which it passes through unchanged.
+		n := toNRGBA(img)
+		img = &image.RGBA{Pix: n.Pix, Stride: n.Stride, Rect: n.Rect}
+	}
+	options := &webp.Options{Lossless: opts.Lossless, Quality: opts.quality(), Exact: opts.Exact}
+	if err := webp.Encode(w, img, options); err != nil {
+		return fmt.Errorf("chai2010: %w", err)
+	}
+	return nil
+}
+
+// isGray reports whether img is a grayscale image, which chai2010/webp
+// encodes without converting it to RGB.
+func isGray(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+func (chai2010Encoder) Extension() string { return ".webp" }
+func (chai2010Encoder) MIMEType() string  { return "image/webp" }
@@ -0,0 +1,172 @@
+//go:build cgo
+
+package converter_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"testing"
+
+	"imageconverter/internal/converter"
+)
+
+// These tests rely on lossy encoding, which only the cgo backend provides.
+
+func TestDefaultWebPEncoder_PrefersChai2010(t *testing.T) {
+	if converter.DefaultWebPEncoder() != converter.EncoderChai2010 {
+		t.Errorf("Expected chai2010 to be the default encoder in cgo builds, got %q", converter.DefaultWebPEncoder())
+	}
+}
+
+func TestReencodeWebP_KeepsOnlySmallerResult(t *testing.T) {
+	inputFile := "test_reencode.webp"
+	createNoisyWebP(t, inputFile, 100)
+	defer os.Remove(inputFile)
+
+	res, err := converter.ReencodeWebP(inputFile, converter.Options{Quality: 10})
+	if err != nil {
+		t.Fatalf("ReencodeWebP failed: %v", err)
+	}
+	if !res.Written || res.OutputSize >= res.InputSize {
+		t.Fatalf("Expected a smaller re-encoded file to be written, got %+v", res)
+	}
+	stat, err := os.Stat(inputFile)
+	if err != nil {
+		t.Fatalf("Failed to stat re-encoded file: %v", err)
+	}
+	if stat.Size() != res.OutputSize {
+		t.Errorf("Expected file size %d after re-encoding, got %d", res.OutputSize, stat.Size())
+	}
+
+	// Re-encoding the now heavily compressed file at maximum quality must not grow it.
+	before, err := os.ReadFile(inputFile)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	res, err = converter.ReencodeWebP(inputFile, converter.Options{Quality: 100})
+	if err != nil {
+		t.Fatalf("ReencodeWebP (quality 100) failed: %v", err)
+	}
+	after, err := os.ReadFile(inputFile)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if res.Written || !bytes.Equal(before, after) {
+		t.Errorf("Expected the original to be kept when re-encoding is larger, got %+v", res)
+	}
+}
+
+func TestConvert_AutoModePicksSmallerEncoding(t *testing.T) {
+	logoFile := "test_auto_logo.png"
+	logo := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.NRGBA{R: 200, G: 30, B: 30, A: 255}
+			if (x/8+y/8)%2 == 0 {
+				c = color.NRGBA{A: 0}
+			}
+			logo.SetNRGBA(x, y, c)
+		}
+	}
+	file, err := os.Create(logoFile)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", logoFile, err)
+	}
+	if err := png.Encode(file, logo); err != nil {
+		t.Fatalf("Failed to encode %s: %v", logoFile, err)
+	}
+	file.Close()
+	defer os.Remove(logoFile)
+
+	photoFile := "test_auto_photo.webp"
+	createNoisyWebP(t, photoFile, 90)
+	defer os.Remove(photoFile)
+
+	outputFile := "test_auto_out.webp"
+	defer os.Remove(outputFile)
+	for _, tc := range []struct {
+		input        string
+		wantLossless bool
+	}{
+		{logoFile, true},
+		{photoFile, false},
+	} {
+		res, err := converter.Convert(tc.input, outputFile, true, converter.Options{Auto: true})
+		if err != nil {
+			t.Fatalf("Convert %s in auto mode failed: %v", tc.input, err)
+		}
+		if res.Lossless != tc.wantLossless || res.OtherModeSize < res.OutputSize {
+			t.Errorf("%s: expected lossless=%t to win with the smaller size, got %+v", tc.input, tc.wantLossless, res)
+		}
+	}
+}
+
+func TestChai2010_StraightAlpha(t *testing.T) {
+	// chai2010/webp hands libwebp premultiplied pixels unless they are
+	// converted first, which darkens semi-transparent colours.
+	for name, img := range alphaFixtures() {
+		for _, lossless := range []bool{true, false} {
+			out, _ := convertPNG(t, img, converter.Options{Encoder: converter.EncoderChai2010, Lossless: lossless, Quality: 100})
+			got := color.NRGBAModel.Convert(out.At(0, 0)).(color.NRGBA)
+			if got.R < 200 || got.A < 120 || got.A > 136 {
+				t.Errorf("%s, lossless %t: semi-transparent pixel is %v, expected about red at half alpha", name, lossless, got)
+			}
+		}
+	}
+}
+
+func TestChai2010_Exact(t *testing.T) {
+	img := alphaFixtures()["NRGBA"]
+	out, _ := convertPNG(t, img, converter.Options{Encoder: converter.EncoderChai2010, Lossless: true, Exact: true})
+	if got := color.NRGBAModel.Convert(out.At(1, 0)); got != (color.NRGBA{R: 10, G: 20, B: 30}) {
+		t.Errorf("Transparent pixel is %v with Exact, expected its colour to be kept", got)
+	}
+
+	// Lossy encoding cannot keep it, but auto mode falls back to lossless.
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	if _, _, err := converter.ConvertBytes(buf.Bytes(), converter.Options{Encoder: converter.EncoderChai2010, Exact: true}); err == nil {
+		t.Error("Lossy encoding with Exact did not fail")
+	}
+	_, res, err := converter.ConvertBytes(buf.Bytes(), converter.Options{Encoder: converter.EncoderChai2010, Auto: true, Exact: true})
+	if err != nil || !res.Lossless {
+		t.Errorf("Auto mode with Exact gave %+v, %v, expected a lossless result", res, err)
+	}
+}
+
+func TestChai2010_AlphaQualityAndOpaqueAlpha(t *testing.T) {
+	// A horizontal alpha gradient over noise.
+	rng := rand.New(rand.NewSource(3))
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 32))
+	rng.Read(img.Pix)
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 256; x++ {
+			img.Pix[img.PixOffset(x, y)+3] = uint8(x)
+		}
+	}
+	_, full := convertPNG(t, img, converter.Options{Encoder: converter.EncoderChai2010, Quality: 50})
+	out, reduced := convertPNG(t, img, converter.Options{Encoder: converter.EncoderChai2010, Quality: 50, AlphaQuality: 10})
+	if len(reduced) >= len(full) {
+		t.Errorf("Alpha quality 10 gave %d bytes, expected fewer than the %d bytes of full alpha", len(reduced), len(full))
+	}
+	levels := make(map[uint8]bool)
+	for x := 0; x < 256; x++ {
+		levels[color.NRGBAModel.Convert(out.At(x, 0)).(color.NRGBA).A] = true
+	}
+	if len(levels) > 4 {
+		t.Errorf("Alpha quality 10 kept %d alpha levels, expected 4", len(levels))
+	}
+
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	for _, lossless := range []bool{true, false} {
+		if _, data := convertPNG(t, img, converter.Options{Encoder: converter.EncoderChai2010, Lossless: lossless}); hasAlpha(data) || bytes.Contains(data, []byte("ALPH")) {
+			t.Errorf("Lossless %t: output of an opaque NRGBA image has an alpha channel", lossless)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package converter
+
+// cgoWebPEncoders returns the WebP encoder backends that need cgo, of which
+// there are none in builds with cgo disabled.
+func cgoWebPEncoders() map[string]Encoder {
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package converter_test
+
+import (
+	"testing"
+
+	"imageconverter/internal/converter"
+)
+
+func TestDefaultWebPEncoder_FallsBackToVP8L(t *testing.T) {
+	if converter.DefaultWebPEncoder() != converter.EncoderVP8L {
+		t.Errorf("Expected vp8l to be the default encoder in builds without cgo, got %q", converter.DefaultWebPEncoder())
+	}
+}
@@ -0,0 +1,24 @@
+package converter
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	"imageconverter/internal/vp8l"
+)
+
+// vp8lEncoder encodes lossless WebP with the pure-Go encoder in
+// internal/vp8l. It works without cgo; quality settings are ignored because
+// the output is always lossless.
+type vp8lEncoder struct{}
+
+func (vp8lEncoder) Encode(w io.Writer, img image.Image, opts Options) error {
+	if err := vp8l.EncodeOptions(w, img, vp8l.Options{Exact: opts.Exact}); err != nil {
+		return fmt.Errorf("vp8l: %w", err)
+	}
+	return nil
+}
+
+func (vp8lEncoder) Extension() string { return ".webp" }
+func (vp8lEncoder) MIMEType() string  { return "image/webp" }
@@ -0,0 +1,81 @@
+package converter
+
+import (
+	"image"
+)
+
+// to8Bit converts images with 16 bits per channel, such as those decoded
+// from 16-bit PNG and TIFF files, and CMYK images, such as Adobe CMYK JPEGs,
+// to 8-bit NRGBA, or 8-bit Gray for 16-bit grayscale. Other images,
+// including 8-bit gray+alpha PNGs, which decode to NRGBA, are returned
+// unchanged.
+//
+// The encoders would otherwise convert such images one pixel at a time
+// through premultiplied 16-bit colour, truncating every channel on the way
+// back to 8 bits, which shifts colours and loses most of the precision of
+// faint semi-transparent pixels. Here each channel is rounded once.
+func to8Bit(img image.Image) image.Image {
+	switch src := img.(type) {
+	case *image.NRGBA64:
+		dst := image.NewNRGBA(src.Rect)
+		eachPixel(src.Rect, func(x, y int) {
+			s, d := src.PixOffset(x, y), dst.PixOffset(x, y)
+			for c := range 4 {
+				dst.Pix[d+c] = round16(src.Pix[s+2*c:])
+			}
+		})
+		return dst
+	case *image.RGBA64:
+		dst := image.NewNRGBA(src.Rect)
+		eachPixel(src.Rect, func(x, y int) {
+			s, d := src.PixOffset(x, y), dst.PixOffset(x, y)
+			a := uint32(src.Pix[s+6])<<8 | uint32(src.Pix[s+7])
+			if a == 0 {
+				return
+			}
+			// Undo the premultiplication before rounding.
+			for c := range 3 {
+				v := uint32(src.Pix[s+2*c])<<8 | uint32(src.Pix[s+2*c+1])
+				dst.Pix[d+c] = uint8(min((v*255+a/2)/a, 255))
+			}
+			dst.Pix[d+3] = round16(src.Pix[s+6:])
+		})
+		return dst
+	case *image.Gray16:
+		dst := image.NewGray(src.Rect)
+		eachPixel(src.Rect, func(x, y int) {
+			dst.Pix[dst.PixOffset(x, y)] = round16(src.Pix[src.PixOffset(x, y):])
+		})
+		return dst
+	case *image.CMYK:
+		// The JPEG decoder has already undone the inversion of Adobe CMYK
+		// files, where 255 means no ink.
+		dst := image.NewNRGBA(src.Rect)
+		eachPixel(src.Rect, func(x, y int) {
+			s, d := src.PixOffset(x, y), dst.PixOffset(x, y)
+			w := 255 - uint32(src.Pix[s+3])
+			for c := range 3 {
+				dst.Pix[d+c] = uint8(((255-uint32(src.Pix[s+c]))*w + 127) / 255)
+			}
+			dst.Pix[d+3] = 255
+		})
+		return dst
+	}
+	return img
+}
+
+// round16 rounds the big-endian 16-bit channel value at the start of b to
+// 8 bits.
+func round16(b []byte) uint8 {
+	v := uint32(b[0])<<8 | uint32(b[1])
+	return uint8((v*255 + 32767) / 65535)
+}
+
+// eachPixel calls f for every pixel of r.
+func eachPixel(r image.Rectangle, f func(x, y int)) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			f(x, y)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package converter
+
+import (
+	"image"
+	"log/slog"
+
+	"imageconverter/internal/icc"
+)
+
+// toSRGB converts img, decoded from data, from the colour space of the ICC
+// profile embedded in data to sRGB. Images without a profile, with an sRGB
+// profile or with one that cannot be converted from are returned unchanged.
+func toSRGB(img image.Image, data []byte, name string) image.Image {
+	raw := icc.Extract(data)
+	if raw == nil {
+		return img
+	}
+	profile, err := icc.Parse(raw)
+	if err != nil {
+		slog.Warn("Leaving colours unconverted", "file", name, "error", err)
+		return img
+	}
+	if profile.IsSRGB() {
+		return img
+	}
+	slog.Debug("Converted to sRGB", "file", name, "profile", profile.Description)
+	return profile.ToSRGB(img)
+}
@@ -1,61 +1,494 @@
 package converter
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
 
-	"github.com/chai2010/webp"
+	"golang.org/x/image/draw"
+	xwebp "golang.org/x/image/webp"
 )
 
-// ConvertToWebP converts an image file (PNG or JPEG) to WebP format.
+// DefaultQuality is the lossy WebP quality used when Options.Quality is zero.
+const DefaultQuality = 80
+
+// Options controls how an input image is decoded and encoded.
+type Options struct {
+	// Format is the output format: FormatWebP (the default when empty),
+	// FormatPNG or FormatJPEG.
+	Format string
+	// Encoder names the WebP encoder backend (see WebPEncoderNames).
+	// Empty selects DefaultWebPEncoder. It is ignored for PNG and JPEG output.
+	Encoder string
+	// Page is the zero-based page to decode from multi-page inputs (TIFF).
+	// It is ignored for single-image formats.
+	Page int
+	// Quality is the lossy WebP or JPEG quality from 1 to 100. Zero selects DefaultQuality.
+	Quality float32
+	// Lossless selects lossless WebP encoding; Quality is then ignored for WebP.
+	Lossless bool
+	// Auto encodes WebP both lossy and lossless and keeps the smaller
+	// result; Lossless is then ignored. Formats and backends that support
+	// only one of the modes use that mode.
+	Auto bool
+	// MaxWidth and MaxHeight downscale the image, preserving its aspect
+	// ratio, so that it fits within the given bounds. Zero means no limit.
+	MaxWidth  int
+	MaxHeight int
+	// TargetSize, when positive, is the largest encoded size in bytes. The
+	// highest quality up to Quality that fits is found by binary search, and
+	// the image is downscaled further if even the lowest quality is too large.
+	TargetSize int64
+	// TargetSSIM and TargetPSNR, when positive, select the lowest quality
+	// whose decoded output reaches the given SSIM (0 to 1) or PSNR (in
+	// decibels) against the source image. At most one of TargetSize,
+	// TargetSSIM and TargetPSNR may be set.
+	TargetSSIM float64
+	TargetPSNR float64
+	// AlphaQuality is the quality of the alpha channel of lossy WebP
+	// output, from 1 to 100. Lower values reduce the alpha channel to fewer
+	// levels, which compresses better. Zero selects 100, which keeps it intact.
+	AlphaQuality float32
+	// Exact preserves the colour of fully transparent pixels in WebP output.
+	// Otherwise it is discarded, which compresses better. Only lossless
+	// encoding can preserve it.
+	Exact bool
+	// ToSRGB converts images with an embedded RGB matrix/TRC ICC profile,
+	// such as Adobe RGB or Display P3, to sRGB before encoding, since the
+	// profile is not carried over to the output. Other profiles are left
+	// alone.
+	ToSRGB bool
+	// Background, if set, is the colour transparent images are composited
+	// onto, so that the output is opaque.
+	Background color.Color
+	// OnlyIfSmaller discards the output instead of writing it unless it is
+	// at least MinSavings percent smaller than the input file. Result.Written
+	// reports whether the output was kept.
+	OnlyIfSmaller bool
+	MinSavings    float64
+}
+
+// keep reports whether an output of outputSize bytes should be written for
+// an input of inputSize bytes under the OnlyIfSmaller setting.
+func (opts Options) keep(inputSize, outputSize int64) bool {
+	if !opts.OnlyIfSmaller {
+		return true
+	}
+	return outputSize < inputSize && float64(outputSize) <= float64(inputSize)*(1-opts.MinSavings/100)
+}
+
+// Validate reports an error if more than one of TargetSize, TargetSSIM and
+// TargetPSNR is set, or if Exact is set for WebP output that would be
+// encoded lossy, which cannot preserve the colour of transparent pixels.
+func (opts Options) Validate() error {
+	if opts.Exact && !opts.Auto {
+		if enc, err := EncoderFor(opts.Format); err == nil && enc.MIMEType() == "image/webp" && usesQuality(enc, opts) {
+			return errors.New("exact mode needs lossless or auto mode")
+		}
+	}
+	targets := 0
+	for _, set := range []bool{opts.TargetSize > 0, opts.TargetSSIM > 0, opts.TargetPSNR > 0} {
+		if set {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return errors.New("only one of a target size, SSIM or PSNR can be set")
+	}
+	return nil
+}
+
+// quality returns the effective lossy quality for opts.
+func (opts Options) quality() float32 {
+	if opts.Quality == 0 {
+		return DefaultQuality
+	}
+	return opts.Quality
+}
+
+// Result describes the outcome of a single conversion.
+type Result struct {
+	InputSize  int64 // Size of the input file in bytes.
+	OutputSize int64 // Size of the encoded image in bytes.
+	Width      int   // Width of the encoded image.
+	Height     int   // Height of the encoded image.
+	// Quality is the lossy quality the image was encoded at, or zero if the
+	// encoder ignores quality (PNG, lossless WebP).
+	Quality float32
+	// SSIM or PSNR is the similarity the output achieved when
+	// Options.TargetSSIM or Options.TargetPSNR is set, and zero otherwise.
+	// The target may not have been met if even the highest quality fell short.
+	SSIM float64
+	PSNR float64
+	// Lossless reports whether the output was encoded losslessly.
+	Lossless bool
+	// OtherModeSize is the size of the discarded encoding in auto mode, and
+	// zero otherwise.
+	OtherModeSize int64
+	// Written is false when the encoded image was discarded instead of
+	// being written, e.g. when re-encoding a WebP did not make it smaller
+	// or when Options.OnlyIfSmaller rejected it.
+	Written bool
+}
+
+// ConvertToWebP converts an image file (PNG, JPEG, GIF, BMP or TIFF) to WebP format.
 // If force is true, it will overwrite the outputFile if it already exists.
 func ConvertToWebP(inputFile string, outputFile string, force bool) error {
+	_, err := Convert(inputFile, outputFile, force, Options{})
+	return err
+}
+
+// Convert converts an image file to the format selected by opts.Format
+// (WebP by default) using the given options.
+// If force is true, it will overwrite the outputFile if it already exists.
+func Convert(inputFile string, outputFile string, force bool, opts Options) (Result, error) {
 	// Check if output file exists
 	if _, err := os.Stat(outputFile); err == nil { // File exists
 		if !force {
-			return fmt.Errorf("output file %s already exists, use --force to overwrite", outputFile)
+			return Result{}, fmt.Errorf("output file %s already exists, use --force to overwrite", outputFile)
 		}
-		// If force is true, we can optionally print a message here or just proceed
-		// fmt.Printf("Output file %s exists, overwriting due to --force flag.\n", outputFile)
+		slog.Debug("Overwriting existing output", "output", outputFile)
 	} else if !errors.Is(err, os.ErrNotExist) { // Another error occurred with os.Stat
-		return fmt.Errorf("failed to check output file %s: %w", outputFile, err)
+		return Result{}, fmt.Errorf("failed to check output file %s: %w", outputFile, err)
 	}
 	// If os.ErrNotExist, proceed to create the file
 
-	// Open input file
-	file, err := os.Open(inputFile)
+	img, inputSize, err := decodeFile(inputFile, opts)
 	if err != nil {
-		return fmt.Errorf("failed to open input file %s: %w", inputFile, err)
+		return Result{}, err
 	}
-	defer file.Close()
 
-	// Decode the image
-	img, format, err := image.Decode(file)
+	enc, err := EncoderFor(opts.Format)
 	if err != nil {
-		// It's useful to know which format failed, if image.Decode can provide it.
-		// If format is empty, it means the decoder couldn't even determine the format.
-		if format != "" {
-			return fmt.Errorf("failed to decode image %s (format: %s): %w", inputFile, format, err)
-		}
-		return fmt.Errorf("failed to decode image %s (unknown format): %w", inputFile, err)
+		return Result{}, err
+	}
+	out, err := encode(enc, img, opts)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to encode image %s to %s: %w", inputFile, enc.MIMEType(), err)
+	}
+
+	res := out.result(inputSize)
+	if !opts.keep(res.InputSize, res.OutputSize) {
+		return res, nil
+	}
+	if err := writeFile(outputFile, out.data); err != nil {
+		return Result{}, err
+	}
+	res.Written = true
+	return res, nil
+}
+
+// ConvertBytes converts an image held in memory, in any supported input
+// format including WebP, and returns the encoded output. Options.OnlyIfSmaller
+// is ignored and Result.Written is always false, since nothing is written.
+func ConvertBytes(data []byte, opts Options) ([]byte, Result, error) {
+	img, err := decodeData(data, opts, "data")
+	if err != nil {
+		return nil, Result{}, err
+	}
+	enc, err := EncoderFor(opts.Format)
+	if err != nil {
+		return nil, Result{}, err
+	}
+	out, err := encode(enc, img, opts)
+	if err != nil {
+		return nil, Result{}, fmt.Errorf("failed to encode image to %s: %w", enc.MIMEType(), err)
+	}
+	return out.data, out.result(int64(len(data))), nil
+}
+
+// ReencodeWebP re-encodes the WebP file at path with the given options and
+// replaces it only if the result is smaller than the original, by at least
+// opts.MinSavings percent when opts.OnlyIfSmaller is set. Re-encoding
+// drops any metadata (EXIF, XMP, ICC) carried by the original file.
+func ReencodeWebP(path string, opts Options) (Result, error) {
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to open input file %s: %w", path, err)
+	}
+	img, err := xwebp.Decode(bytes.NewReader(original))
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to decode image %s (format: webp): %w", path, err)
+	}
+	if opts.ToSRGB {
+		img = toSRGB(img, original, path)
+	}
+
+	enc := webpEncoder{}
+	out, err := encode(enc, img, opts)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to encode image %s to %s: %w", path, enc.MIMEType(), err)
+	}
+
+	res := out.result(int64(len(original)))
+	opts.OnlyIfSmaller = true
+	if !opts.keep(res.InputSize, res.OutputSize) {
+		return res, nil
+	}
+	if err := writeFile(path, out.data); err != nil {
+		return Result{}, err
+	}
+	res.Written = true
+	return res, nil
+}
+
+// CheckDecodable reads the file at path and decodes it as the given output
+// format, returning an error if it is not a complete, valid image.
+func CheckDecodable(path string, format string) error {
+	enc, err := EncoderFor(format)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if _, err := decodeOutput(enc, data); err != nil {
+		return fmt.Errorf("failed to decode %s as %s: %w", path, enc.MIMEType(), err)
+	}
+	return nil
+}
+
+// encoded is an image encoded in memory.
+type encoded struct {
+	data       []byte
+	img        image.Image // The image that was encoded, after any resizing.
+	quality    float32     // Zero if the encoder ignores quality.
+	ssim, psnr float64     // Set when searching for a perceptual target.
+	lossless   bool
+	otherSize  int64 // Size of the discarded encoding in auto mode.
+}
+
+// result describes e as the output of converting an input of inputSize bytes.
+func (e encoded) result(inputSize int64) Result {
+	bounds := e.img.Bounds()
+	return Result{
+		InputSize:  inputSize,
+		OutputSize: int64(len(e.data)),
+		Width:      bounds.Dx(),
+		Height:     bounds.Dy(),
+		Quality:    e.quality,
+		SSIM:       e.ssim,
+		PSNR:       e.psnr,
+
+		Lossless:      e.lossless,
+		OtherModeSize: e.otherSize,
+	}
+}
+
+// encode flattens and resizes img according to opts and encodes it with enc
+// in memory, searching for a quality and size that fit opts.TargetSize if it
+// is set. In auto mode both lossy and lossless encodings are tried.
+func encode(enc Encoder, img image.Image, opts Options) (encoded, error) {
+	if opts.Background != nil {
+		img = flatten(img, opts.Background)
 	}
+	bounds := img.Bounds()
+	img = resize(img, opts.MaxWidth, opts.MaxHeight)
+	if img.Bounds() != bounds {
+		slog.Debug("Downscaled image", "from_width", bounds.Dx(), "from_height", bounds.Dy(),
+			"width", img.Bounds().Dx(), "height", img.Bounds().Dy())
+	}
+	if !opts.Auto {
+		return encodeMode(enc, img, opts)
+	}
+
+	lossy, lossless := opts, opts
+	lossy.Lossless, lossless.Lossless = false, true
+	if opts.Exact && usesQuality(enc, lossy) && !usesQuality(enc, lossless) {
+		// Lossy encoding cannot preserve the colour of transparent pixels.
+		return encodeMode(enc, img, lossless)
+	}
+	if !usesQuality(enc, lossy) || usesQuality(enc, lossless) {
+		// Only one mode is available, so there is nothing to choose.
+		return encodeMode(enc, img, lossy)
+	}
+	lossyOut, lossyErr := encodeMode(enc, img, lossy)
+	losslessOut, losslessErr := encodeMode(enc, img, lossless)
+	slog.Debug("Encoded both modes", "lossy_bytes", len(lossyOut.data), "lossy_error", lossyErr,
+		"lossless_bytes", len(losslessOut.data), "lossless_error", losslessErr)
+	switch {
+	case lossyErr != nil && losslessErr != nil:
+		return encoded{}, lossyErr
+	case lossyErr != nil:
+		return losslessOut, nil
+	case losslessErr != nil:
+		return lossyOut, nil
+	case len(losslessOut.data) <= len(lossyOut.data):
+		losslessOut.otherSize = int64(len(lossyOut.data))
+		return losslessOut, nil
+	}
+	lossyOut.otherSize = int64(len(losslessOut.data))
+	return lossyOut, nil
+}
 
-	// Create output file
-	output, err := os.Create(outputFile)
+// encodeMode encodes img, which has already been resized, in the single
+// mode selected by opts.Lossless.
+func encodeMode(enc Encoder, img image.Image, opts Options) (encoded, error) {
+	if err := opts.Validate(); err != nil {
+		return encoded{}, err
+	}
+	var out encoded
+	var err error
+	switch {
+	case opts.TargetSize > 0:
+		out, err = encodeToSize(enc, img, opts)
+	case opts.TargetSSIM > 0 || opts.TargetPSNR > 0:
+		out, err = encodeToSimilarity(enc, img, opts)
+	default:
+		var data []byte
+		data, err = encodeAt(enc, img, opts, opts.quality())
+		out = encoded{data: data, img: img}
+		if usesQuality(enc, opts) {
+			out.quality = opts.quality()
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create output file %s: %w", outputFile, err)
+		return encoded{}, err
+	}
+	out.lossless = !usesQuality(enc, opts)
+	return out, nil
+}
+
+// encodeAt encodes img with enc in memory at the given quality.
+func encodeAt(enc Encoder, img image.Image, opts Options, quality float32) ([]byte, error) {
+	opts.Quality = quality
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, img, opts); err != nil {
+		return nil, err
 	}
-	defer output.Close()
+	return buf.Bytes(), nil
+}
 
-	// Encode the image to WebP
-	// Using github.com/chai2010/webp, a common way to encode is with options.
-	// Let's use some default lossy options.
-	options := &webp.Options{Lossless: false, Quality: 80.0}
-	if err := webp.Encode(output, img, options); err != nil {
-		return fmt.Errorf("failed to encode image %s to WebP (chai2010): %w", inputFile, err)
+// resize downscales img to fit within maxWidth x maxHeight, preserving the
+// aspect ratio. Images that already fit are returned unchanged, as are
+// images when both limits are zero.
+func resize(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	newWidth, newHeight := FitSize(bounds.Dx(), bounds.Dy(), maxWidth, maxHeight)
+	if newWidth == bounds.Dx() && newHeight == bounds.Dy() {
+		return img
 	}
 
+	return scaleTo(img, newWidth, newHeight)
+}
+
+// scaleTo scales img to exactly width x height.
+func scaleTo(img image.Image, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// FitSize returns the dimensions of a width x height image downscaled to fit
+// within maxWidth x maxHeight with its aspect ratio preserved, as done by
+// Options.MaxWidth and Options.MaxHeight. A zero limit means no limit.
+func FitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+	if scale == 1.0 {
+		return width, height
+	}
+	return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
+}
+
+// writeFile writes data to path through a temporary file in the same
+// directory, so that readers never observe a partially written output.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create output file %s: %w", path, err)
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to write output file %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to write output file %s: %w", path, err)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to set permissions on output file %s: %w", path, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to create output file %s: %w", path, err)
+	}
 	return nil
 }
+
+// decodeFile decodes the image stored in inputFile. Multi-page TIFF files
+// are decoded at opts.Page; every other format must use page 0. The image
+// is converted to sRGB if opts.ToSRGB is set. It also returns the size of
+// the file in bytes.
+func decodeFile(inputFile string, opts Options) (image.Image, int64, error) {
+	data, err := os.ReadFile(inputFile)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open input file %s: %w", inputFile, err)
+	}
+	img, err := decodeData(data, opts, inputFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	return img, int64(len(data)), nil
+}
+
+// decodeData decodes an image held in memory like decodeFile, and converts
+// 16-bit and CMYK images to 8 bits per channel. name describes the image in
+// error messages.
+func decodeData(data []byte, opts Options, name string) (image.Image, error) {
+	img, err := decodeImage(data, opts.Page, name)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ToSRGB {
+		img = toSRGB(img, data, name)
+	}
+	if converted := to8Bit(img); converted != img {
+		slog.Debug("Converted to 8 bits per channel", "file", name, "from", fmt.Sprintf("%T", img))
+		img = converted
+	}
+	return img, nil
+}
+
+// decodeImage decodes data at the given page, as it is stored.
+func decodeImage(data []byte, page int, name string) (image.Image, error) {
+	if IsTIFF(data) {
+		img, err := decodeTIFFPage(data, page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image %s (format: tiff): %w", name, err)
+		}
+		slog.Debug("Decoded image", "file", name, "format", "tiff", "page", page+1, "width", img.Bounds().Dx(), "height", img.Bounds().Dy())
+		return img, nil
+	}
+	if page != 0 {
+		return nil, fmt.Errorf("failed to decode image %s: page %d requested but the format has no pages", name, page+1)
+	}
+
+	// Decode the image
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// It's useful to know which format failed, if image.Decode can provide it.
+		// If format is empty, it means the decoder couldn't even determine the format.
+		if format != "" {
+			return nil, fmt.Errorf("failed to decode image %s (format: %s): %w", name, format, err)
+		}
+		return nil, fmt.Errorf("failed to decode image %s (unknown format): %w", name, err)
+	}
+	slog.Debug("Decoded image", "file", name, "format", format, "width", img.Bounds().Dx(), "height", img.Bounds().Dy())
+	return img, nil
+}
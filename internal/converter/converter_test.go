@@ -2,14 +2,25 @@ package converter_test
 
 import (
 	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
+	"math"
+	"math/bits"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
-	"github.com/chai2010/webp" // Changed from golang.org/x/image/webp
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
 
 	"imageconverter/internal/converter"
 )
@@ -35,6 +46,14 @@ func createDummyImage(t *testing.T, filename string, format string) {
 		if err := jpeg.Encode(file, img, nil); err != nil {
 			t.Fatalf("Failed to encode dummy JPEG %s: %v", filename, err)
 		}
+	case "bmp":
+		if err := bmp.Encode(file, img); err != nil {
+			t.Fatalf("Failed to encode dummy BMP %s: %v", filename, err)
+		}
+	case "tiff":
+		if err := tiff.Encode(file, img, nil); err != nil {
+			t.Fatalf("Failed to encode dummy TIFF %s: %v", filename, err)
+		}
 	default:
 		t.Fatalf("Unsupported dummy image format: %s", format)
 	}
@@ -197,3 +216,801 @@ func TestConvertToWebP_InvalidInputFormat(t *testing.T) {
 		t.Errorf("Expected error message to indicate a decoding failure, got '%s'", err.Error())
 	}
 }
+
+// Helper function to create an uncompressed 8-bit grayscale TIFF with one
+// 1x1 page per gray level. golang.org/x/image/tiff can only write single-page
+// files, so the IFD chain is assembled by hand.
+func createMultiPageTIFF(t *testing.T, filename string, levels []uint8) {
+	t.Helper()
+	le := binary.LittleEndian
+	buf := []byte("II\x2A\x00\x00\x00\x00\x00")
+
+	const entries = 8
+	prevNext := 4 // Position of the pointer to the next IFD.
+	for _, level := range levels {
+		ifd := len(buf)
+		le.PutUint32(buf[prevNext:], uint32(ifd))
+		pixel := ifd + 2 + entries*12 + 4
+
+		buf = le.AppendUint16(buf, entries)
+		for _, e := range [entries][3]uint32{
+			{256, 3, 1},             // ImageWidth
+			{257, 3, 1},             // ImageLength
+			{258, 3, 8},             // BitsPerSample
+			{259, 3, 1},             // Compression: none
+			{262, 3, 1},             // PhotometricInterpretation: BlackIsZero
+			{273, 4, uint32(pixel)}, // StripOffsets
+			{277, 3, 1},             // SamplesPerPixel
+			{279, 4, 1},             // StripByteCounts
+		} {
+			buf = le.AppendUint16(buf, uint16(e[0]))
+			buf = le.AppendUint16(buf, uint16(e[1]))
+			buf = le.AppendUint32(buf, 1)
+			if e[1] == 3 {
+				buf = le.AppendUint16(buf, uint16(e[2]))
+				buf = le.AppendUint16(buf, 0)
+			} else {
+				buf = le.AppendUint32(buf, e[2])
+			}
+		}
+		prevNext = len(buf)
+		buf = le.AppendUint32(buf, 0)
+		buf = append(buf, level, 0) // Pixel data, padded to a word boundary.
+	}
+
+	if err := os.WriteFile(filename, buf, 0644); err != nil {
+		t.Fatalf("Failed to write multi-page TIFF %s: %v", filename, err)
+	}
+}
+
+func TestConvertToWebP_SuccessBMPAndTIFF(t *testing.T) {
+	for _, format := range []string{"bmp", "tiff"} {
+		inputFile := "test_input." + format
+		outputFile := "test_output_" + format + ".webp"
+		createDummyImage(t, inputFile, format)
+		defer os.Remove(inputFile)
+		defer os.Remove(outputFile)
+
+		if err := converter.ConvertToWebP(inputFile, outputFile, false); err != nil {
+			t.Fatalf("ConvertToWebP failed for %s: %v", format, err)
+		}
+
+		file, err := os.Open(outputFile)
+		if err != nil {
+			t.Fatalf("Failed to open output WebP file %s for verification: %v", outputFile, err)
+		}
+		defer file.Close()
+		if _, err := webp.Decode(file); err != nil {
+			t.Fatalf("Failed to decode output WebP file %s, it might be invalid: %v", outputFile, err)
+		}
+	}
+}
+
+func TestConvert_MultiPageTIFF(t *testing.T) {
+	inputFile := "test_multipage.tiff"
+	createMultiPageTIFF(t, inputFile, []uint8{0, 255})
+	defer os.Remove(inputFile)
+
+	count, err := converter.TIFFPageCount(inputFile)
+	if err != nil {
+		t.Fatalf("TIFFPageCount failed: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 pages, got %d", count)
+	}
+
+	for page, wantBright := range []bool{false, true} {
+		outputFile := "test_multipage_page.webp"
+		if _, err := converter.Convert(inputFile, outputFile, true, converter.Options{Page: page}); err != nil {
+			t.Fatalf("Convert failed for page %d: %v", page, err)
+		}
+		data, err := os.ReadFile(outputFile)
+		os.Remove(outputFile)
+		if err != nil {
+			t.Fatalf("Failed to read output for page %d: %v", page, err)
+		}
+		img, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to decode output for page %d: %v", page, err)
+		}
+		r, _, _, _ := img.At(0, 0).RGBA()
+		if gotBright := r > 0x8000; gotBright != wantBright {
+			t.Errorf("Page %d: expected bright=%t, got red=%#x", page, wantBright, r)
+		}
+	}
+
+	if _, err := converter.Convert(inputFile, "test_multipage_oob.webp", true, converter.Options{Page: 2}); err == nil {
+		os.Remove("test_multipage_oob.webp")
+		t.Errorf("Expected an error when converting a page past the end of the file")
+	}
+}
+
+// Helper function to write a noisy WebP image, which compresses poorly at high
+// quality. It is encoded with the default WebP backend of the build.
+func createNoisyWebP(t *testing.T, filename string, quality float32) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+
+	pngFile := filename + ".png"
+	file, err := os.Create(pngFile)
+	if err != nil {
+		t.Fatalf("Failed to create PNG file %s: %v", pngFile, err)
+	}
+	defer os.Remove(pngFile)
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		t.Fatalf("Failed to encode PNG %s: %v", pngFile, err)
+	}
+	file.Close()
+
+	if _, err := converter.Convert(pngFile, filename, true, converter.Options{Quality: quality}); err != nil {
+		t.Fatalf("Failed to encode WebP %s: %v", filename, err)
+	}
+}
+
+func TestConvert_MaxWidthResizes(t *testing.T) {
+	inputFile := "test_resize.png"
+	outputFile := "test_resize.webp"
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	file, err := os.Create(inputFile)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", inputFile, err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("Failed to encode %s: %v", inputFile, err)
+	}
+	file.Close()
+	defer os.Remove(inputFile)
+	defer os.Remove(outputFile)
+
+	res, err := converter.Convert(inputFile, outputFile, false, converter.Options{MaxWidth: 10, MaxHeight: 100})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if res.Width != 10 || res.Height != 5 {
+		t.Errorf("Expected a 10x5 result, got %dx%d", res.Width, res.Height)
+	}
+}
+
+func TestConvert_ToPNGAndJPEG(t *testing.T) {
+	inputFile := "test_reverse.webp"
+	createNoisyWebP(t, inputFile, 90)
+	defer os.Remove(inputFile)
+
+	for _, tc := range []struct {
+		format string
+		decode func(*os.File) (image.Image, error)
+	}{
+		{converter.FormatPNG, func(f *os.File) (image.Image, error) { return png.Decode(f) }},
+		{converter.FormatJPEG, func(f *os.File) (image.Image, error) { return jpeg.Decode(f) }},
+	} {
+		enc, err := converter.EncoderFor(tc.format)
+		if err != nil {
+			t.Fatalf("EncoderFor(%q) failed: %v", tc.format, err)
+		}
+		outputFile := "test_reverse" + enc.Extension()
+		defer os.Remove(outputFile)
+
+		res, err := converter.Convert(inputFile, outputFile, false, converter.Options{Format: tc.format, Quality: 90})
+		if err != nil {
+			t.Fatalf("Convert to %s failed: %v", tc.format, err)
+		}
+		if res.Width != 64 || res.Height != 64 {
+			t.Errorf("Expected 64x64 %s output, got %dx%d", tc.format, res.Width, res.Height)
+		}
+
+		file, err := os.Open(outputFile)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", outputFile, err)
+		}
+		defer file.Close()
+		if _, err := tc.decode(file); err != nil {
+			t.Errorf("Failed to decode %s output %s: %v", tc.format, outputFile, err)
+		}
+	}
+}
+
+func TestEncoderFor_UnknownFormat(t *testing.T) {
+	if _, err := converter.EncoderFor("gif"); err == nil {
+		t.Errorf("Expected an error for an unsupported output format")
+	}
+	if enc, err := converter.EncoderFor("JPG"); err != nil || enc.MIMEType() != "image/jpeg" {
+		t.Errorf("Expected JPG to select the JPEG encoder, got %v, %v", enc, err)
+	}
+}
+
+func TestWebPEncoder_Selection(t *testing.T) {
+	if _, err := converter.WebPEncoder("no-such-encoder"); err == nil {
+		t.Errorf("Expected an error for an unknown WebP encoder")
+	}
+	for _, name := range converter.WebPEncoderNames() {
+		if _, err := converter.WebPEncoder(name); err != nil {
+			t.Errorf("WebPEncoder(%q) failed for a listed encoder: %v", name, err)
+		}
+	}
+
+	inputFile := "test_encoder_select.png"
+	outputFile := "test_encoder_select.webp"
+	createDummyImage(t, inputFile, "png")
+	defer os.Remove(inputFile)
+	defer os.Remove(outputFile)
+
+	if _, err := converter.Convert(inputFile, outputFile, false, converter.Options{Encoder: "no-such-encoder"}); err == nil {
+		t.Errorf("Expected Convert to fail with an unknown WebP encoder")
+	}
+	if _, err := converter.Convert(inputFile, outputFile, false, converter.Options{Encoder: converter.DefaultWebPEncoder()}); err != nil {
+		t.Errorf("Convert with the default encoder failed: %v", err)
+	}
+}
+
+func TestWebPEncoder_VP8LIsLossless(t *testing.T) {
+	inputFile := "test_vp8l.png"
+	outputFile := "test_vp8l.webp"
+	rng := rand.New(rand.NewSource(2))
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	file, err := os.Create(inputFile)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", inputFile, err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("Failed to encode %s: %v", inputFile, err)
+	}
+	file.Close()
+	defer os.Remove(inputFile)
+	defer os.Remove(outputFile)
+
+	// Quality settings are ignored by the lossless backend.
+	if _, err := converter.Convert(inputFile, outputFile, false, converter.Options{Encoder: converter.EncoderVP8L, Quality: 10}); err != nil {
+		t.Fatalf("Convert with the vp8l encoder failed: %v", err)
+	}
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", outputFile, err)
+	}
+	decoded, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to decode %s: %v", outputFile, err)
+	}
+	for y := 0; y < 23; y++ {
+		for x := 0; x < 37; x++ {
+			want := img.NRGBAAt(x, y)
+			if got := color.NRGBAModel.Convert(decoded.At(x, y)); got != want {
+				t.Fatalf("Pixel (%d, %d): expected %v, got %v", x, y, want, got)
+			}
+		}
+	}
+}
+
+func TestConvert_TargetSize(t *testing.T) {
+	inputFile := "test_target.webp"
+	createNoisyWebP(t, inputFile, 100)
+	defer os.Remove(inputFile)
+
+	for _, format := range []string{converter.FormatWebP, converter.FormatJPEG} {
+		enc, err := converter.EncoderFor(format)
+		if err != nil {
+			t.Fatalf("EncoderFor(%q) failed: %v", format, err)
+		}
+		outputFile := "test_target_out" + enc.Extension()
+		defer os.Remove(outputFile)
+
+		const target = 4000
+		res, err := converter.Convert(inputFile, outputFile, true, converter.Options{Format: format, Quality: 100, TargetSize: target})
+		if err != nil {
+			t.Fatalf("Convert to %s with a target size failed: %v", format, err)
+		}
+		stat, err := os.Stat(outputFile)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", outputFile, err)
+		}
+		if stat.Size() > target || stat.Size() != res.OutputSize {
+			t.Errorf("Expected %s output of at most %d bytes matching the result, got %d bytes (result %+v)", format, target, stat.Size(), res)
+		}
+		if res.Quality >= 100 && res.Width == 64 {
+			t.Errorf("Expected the %s quality or size to be reduced to fit, got %+v", format, res)
+		}
+	}
+
+	if _, err := converter.Convert(inputFile, "test_target_tiny.webp", true, converter.Options{TargetSize: 10}); err == nil {
+		os.Remove("test_target_tiny.webp")
+		t.Errorf("Expected an error for a target size no image can meet")
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	for _, opts := range []converter.Options{{}, {TargetSize: 1000}, {TargetSSIM: 0.9}, {TargetPSNR: 40}} {
+		if err := opts.Validate(); err != nil {
+			t.Errorf("Validate(%+v) failed: %v", opts, err)
+		}
+	}
+	for _, opts := range []converter.Options{{Exact: true, Lossless: true}, {Exact: true, Auto: true}, {Exact: true, Format: converter.FormatPNG}} {
+		if err := opts.Validate(); err != nil {
+			t.Errorf("Validate(%+v) failed: %v", opts, err)
+		}
+	}
+	if converter.UsesQuality(converter.Options{}) {
+		if err := (converter.Options{Exact: true}).Validate(); err == nil {
+			t.Errorf("Expected an error for exact lossy WebP")
+		}
+	}
+	for _, opts := range []converter.Options{{TargetSize: 1000, TargetSSIM: 0.9}, {TargetSSIM: 0.9, TargetPSNR: 40}} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestSSIMAndPSNR(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	a := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	rng.Read(a.Pix)
+	b := image.NewRGBA(a.Bounds())
+	copy(b.Pix, a.Pix)
+
+	if ssim := converter.SSIM(a, b); math.Abs(ssim-1) > 1e-9 {
+		t.Errorf("Expected SSIM 1 for identical images, got %v", ssim)
+	}
+	if psnr := converter.PSNR(a, b); !math.IsInf(psnr, 1) {
+		t.Errorf("Expected infinite PSNR for identical images, got %v", psnr)
+	}
+
+	for i := range b.Pix {
+		b.Pix[i] ^= uint8(rng.Intn(64))
+	}
+	if ssim := converter.SSIM(a, b); ssim >= 0.99 {
+		t.Errorf("Expected a lower SSIM for a distorted image, got %v", ssim)
+	}
+	if psnr := converter.PSNR(a, b); psnr > 30 {
+		t.Errorf("Expected a lower PSNR for a distorted image, got %v", psnr)
+	}
+}
+
+func TestConvert_TargetSSIM(t *testing.T) {
+	inputFile := "test_target_ssim.png"
+	img := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 3), uint8((x * y) % 256), 255})
+		}
+	}
+	file, err := os.Create(inputFile)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", inputFile, err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("Failed to encode %s: %v", inputFile, err)
+	}
+	file.Close()
+	defer os.Remove(inputFile)
+
+	outputFile := "test_target_ssim.jpg"
+	defer os.Remove(outputFile)
+	var lastQuality float32
+	for _, target := range []float64{0.9, 0.99} {
+		res, err := converter.Convert(inputFile, outputFile, true, converter.Options{Format: converter.FormatJPEG, TargetSSIM: target})
+		if err != nil {
+			t.Fatalf("Convert with target SSIM %v failed: %v", target, err)
+		}
+		if res.SSIM < target {
+			t.Errorf("Expected an SSIM of at least %v, got %+v", target, res)
+		}
+		if res.Quality < lastQuality {
+			t.Errorf("Expected a stricter target to need at least quality %v, got %+v", lastQuality, res)
+		}
+		lastQuality = res.Quality
+	}
+	if lastQuality >= 100 {
+		t.Errorf("Expected the search to settle below quality 100, got %v", lastQuality)
+	}
+
+	if _, err := converter.Convert(inputFile, outputFile, true, converter.Options{TargetSSIM: 0.9, TargetSize: 1000}); err == nil {
+		t.Errorf("Expected an error when combining a target size with a target SSIM")
+	}
+}
+
+func TestConvert_AutoModeWithSingleModeFormat(t *testing.T) {
+	inputFile := "test_auto_single.png"
+	outputFile := "test_auto_single.jpg"
+	createDummyImage(t, inputFile, "png")
+	defer os.Remove(inputFile)
+	defer os.Remove(outputFile)
+
+	res, err := converter.Convert(inputFile, outputFile, false, converter.Options{Format: converter.FormatJPEG, Auto: true})
+	if err != nil {
+		t.Fatalf("Convert to JPEG in auto mode failed: %v", err)
+	}
+	if res.Lossless || res.OtherModeSize != 0 {
+		t.Errorf("Expected JPEG to be encoded lossy without a second encoding, got %+v", res)
+	}
+}
+
+func TestConvert_OnlyIfSmaller(t *testing.T) {
+	inputFile := "test_only_if_smaller.webp"
+	outputFile := "test_only_if_smaller.png"
+	createNoisyWebP(t, inputFile, 50)
+	defer os.Remove(inputFile)
+	defer os.Remove(outputFile)
+
+	// Noise does not compress, so PNG cannot save 90% over the WebP.
+	res, err := converter.Convert(inputFile, outputFile, false, converter.Options{Format: converter.FormatPNG, OnlyIfSmaller: true, MinSavings: 90})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if res.Written || res.OutputSize == 0 {
+		t.Errorf("Expected the PNG to be discarded, got %+v", res)
+	}
+	if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+		t.Errorf("Expected %s not to be written, stat error: %v", outputFile, err)
+	}
+}
+
+func TestConvertBytes(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+
+	data, res, err := converter.ConvertBytes(buf.Bytes(), converter.Options{MaxWidth: 4})
+	if err != nil {
+		t.Fatalf("ConvertBytes failed: %v", err)
+	}
+	if res.Written || res.InputSize != int64(buf.Len()) || res.OutputSize != int64(len(data)) {
+		t.Errorf("Unexpected result %+v for %d input and %d output bytes", res, buf.Len(), len(data))
+	}
+	out, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Output is not a WebP image: %v", err)
+	}
+	if b := out.Bounds(); b.Dx() != 4 || b.Dy() != 2 {
+		t.Errorf("Output is %dx%d, expected 4x2", b.Dx(), b.Dy())
+	}
+
+	if _, _, err := converter.ConvertBytes([]byte("not an image"), converter.Options{}); err == nil {
+		t.Error("ConvertBytes accepted invalid data")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := filepath.Join(dir, "verify.png")
+	outputFile := filepath.Join(dir, "verify.png.out")
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	file, err := os.Create(inputFile)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", inputFile, err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("Failed to encode %s: %v", inputFile, err)
+	}
+	file.Close()
+
+	opts := converter.Options{Format: converter.FormatPNG, MaxWidth: 10}
+	if _, err := converter.Convert(inputFile, outputFile, false, opts); err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	v, err := converter.Verify(inputFile, outputFile, opts, true)
+	if err != nil {
+		t.Fatalf("Verify failed on a good output: %v", err)
+	}
+	// PNG is lossless, so the output matches the scaled source exactly.
+	if v.Width != 10 || v.Height != 5 || !math.IsInf(v.PSNR, 1) {
+		t.Errorf("Unexpected verification %+v", v)
+	}
+
+	// An output of the wrong size fails.
+	if _, err := converter.Verify(inputFile, outputFile, converter.Options{Format: converter.FormatPNG}, false); err == nil {
+		t.Error("Verify accepted an output of the wrong size")
+	}
+	// So does a truncated output.
+	data, _ := os.ReadFile(outputFile)
+	os.WriteFile(outputFile, data[:len(data)/2], 0644)
+	if _, err := converter.Verify(inputFile, outputFile, opts, false); err == nil {
+		t.Error("Verify accepted a truncated output")
+	}
+}
+
+// alphaFixtures returns a 2x1 image with a semi-transparent red pixel and a
+// fully transparent pixel, stored both with straight alpha (NRGBA) and
+// premultiplied alpha (RGBA). The NRGBA fixture keeps a colour under its
+// transparent pixel; premultiplied alpha cannot.
+func alphaFixtures() map[string]image.Image {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	nrgba.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 128})
+	nrgba.SetNRGBA(1, 0, color.NRGBA{R: 10, G: 20, B: 30})
+	rgba := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	rgba.SetRGBA(0, 0, color.RGBA{R: 128, A: 128})
+	return map[string]image.Image{"NRGBA": nrgba, "RGBA": rgba}
+}
+
+// convertPNG encodes img as PNG, converts it with opts and decodes the WebP
+// output, which is also returned.
+func convertPNG(t *testing.T, img image.Image, opts converter.Options) (image.Image, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+	data, _, err := converter.ConvertBytes(buf.Bytes(), opts)
+	if err != nil {
+		t.Fatalf("ConvertBytes with %+v failed: %v", opts, err)
+	}
+	out, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Output is not a WebP image: %v", err)
+	}
+	return out, data
+}
+
+// hasAlpha reports whether a WebP file declares an alpha channel, in its
+// VP8X flags or in the header of a simple lossless file.
+func hasAlpha(data []byte) bool {
+	switch string(data[12:16]) {
+	case "VP8X":
+		return data[20]&0x10 != 0
+	case "VP8L":
+		return binary.LittleEndian.Uint32(data[21:25])>>28&1 != 0
+	}
+	return false
+}
+
+func TestConvert_AlphaLossless(t *testing.T) {
+	for name, img := range alphaFixtures() {
+		t.Run(name, func(t *testing.T) {
+			out, _ := convertPNG(t, img, converter.Options{Encoder: converter.EncoderVP8L})
+			if got := color.NRGBAModel.Convert(out.At(0, 0)); got != (color.NRGBA{R: 255, A: 128}) {
+				t.Errorf("Semi-transparent pixel is %v, expected straight red at half alpha", got)
+			}
+			if got := color.NRGBAModel.Convert(out.At(1, 0)); got != (color.NRGBA{}) {
+				t.Errorf("Transparent pixel is %v, expected its colour to be cleared", got)
+			}
+
+			out, _ = convertPNG(t, img, converter.Options{Encoder: converter.EncoderVP8L, Exact: true})
+			want := color.NRGBAModel.Convert(img.At(1, 0))
+			if got := color.NRGBAModel.Convert(out.At(1, 0)); got != want {
+				t.Errorf("Transparent pixel is %v with Exact, expected %v", got, want)
+			}
+		})
+	}
+}
+
+func TestConvert_FlattenAndOpaqueAlpha(t *testing.T) {
+	for name, img := range alphaFixtures() {
+		t.Run(name, func(t *testing.T) {
+			out, data := convertPNG(t, img, converter.Options{Encoder: converter.EncoderVP8L, Background: color.White})
+			if hasAlpha(data) {
+				t.Error("Flattened output has an alpha channel")
+			}
+			if got := color.NRGBAModel.Convert(out.At(0, 0)); got != (color.NRGBA{R: 255, G: 127, B: 127, A: 255}) {
+				t.Errorf("Semi-transparent pixel is %v after flattening onto white", got)
+			}
+			if got := color.NRGBAModel.Convert(out.At(1, 0)); got != (color.NRGBA{R: 255, G: 255, B: 255, A: 255}) {
+				t.Errorf("Transparent pixel is %v after flattening onto white", got)
+			}
+		})
+	}
+
+	// An NRGBA image whose alpha channel is fully opaque is written without one.
+	opaque := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := range opaque.Pix {
+		opaque.Pix[i] = 200
+		if i%4 == 3 {
+			opaque.Pix[i] = 255
+		}
+	}
+	if _, data := convertPNG(t, opaque, converter.Options{Encoder: converter.EncoderVP8L}); hasAlpha(data) {
+		t.Error("Output of an opaque NRGBA image has an alpha channel")
+	}
+}
+
+// adobeRGBJPEG encodes img as a JPEG with an embedded Adobe RGB profile.
+func adobeRGBJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	colorants := [3][3]float64{{0.6097, 0.3111, 0.0195}, {0.2053, 0.6257, 0.0609}, {0.1492, 0.0632, 0.7446}}
+	trc := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33") // Gamma 563/256.
+	profile := make([]byte, 128+4+6*12)
+	copy(profile[16:], "RGB XYZ ")
+	copy(profile[36:], "acsp")
+	binary.BigEndian.PutUint32(profile[128:], 6)
+	for i, name := range []string{"r", "g", "b"} {
+		entry := profile[132+i*24:]
+		copy(entry, name+"XYZ")
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(profile)+i*20))
+		binary.BigEndian.PutUint32(entry[8:], 20)
+		copy(entry[12:], name+"TRC")
+		binary.BigEndian.PutUint32(entry[16:], uint32(len(profile)+60))
+		binary.BigEndian.PutUint32(entry[20:], uint32(len(trc)))
+	}
+	for _, c := range colorants {
+		profile = append(profile, "XYZ \x00\x00\x00\x00"...)
+		for _, v := range c {
+			profile = binary.BigEndian.AppendUint32(profile, uint32(int32(v*65536+0.5)))
+		}
+	}
+	profile = append(profile, trc...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+	payload := append([]byte("ICC_PROFILE\x00\x01\x01"), profile...)
+	data := append([]byte{0xff, 0xd8, 0xff, 0xe2}, byte((len(payload)+2)>>8), byte(len(payload)+2))
+	data = append(data, payload...)
+	return append(data, buf.Bytes()[2:]...)
+}
+
+func TestConvert_ToSRGB(t *testing.T) {
+	// sRGB red, expressed in Adobe RGB.
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 219, A: 255}), image.Point{}, draw.Src)
+	data := adobeRGBJPEG(t, img)
+
+	for _, tc := range []struct {
+		toSRGB bool
+		want   uint8
+	}{{false, 219}, {true, 255}} {
+		out, _, err := converter.ConvertBytes(data, converter.Options{Format: converter.FormatPNG, ToSRGB: tc.toSRGB})
+		if err != nil {
+			t.Fatalf("ConvertBytes failed: %v", err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("Output is not a PNG image: %v", err)
+		}
+		r, g, b, _ := decoded.At(8, 8).RGBA()
+		if diff := int(r>>8) - int(tc.want); diff < -4 || diff > 4 || g>>8 > 4 || b>>8 > 4 {
+			t.Errorf("ToSRGB %v: expected red %d, got %d, %d, %d", tc.toSRGB, tc.want, r>>8, g>>8, b>>8)
+		}
+	}
+}
+
+// pngChunk encodes a PNG chunk with its CRC.
+func pngChunk(kind string, data []byte) []byte {
+	body := append([]byte(kind), data...)
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	return binary.BigEndian.AppendUint32(append(out, body...), crc32.ChecksumIEEE(body))
+}
+
+// grayAlphaPNG encodes a 1x1 gray+alpha PNG with the given bit depth, 8 or
+// 16, which the standard library can decode but not encode.
+func grayAlphaPNG(depth int, gray, alpha uint16) []byte {
+	ihdr := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 1), 1)
+	ihdr = append(ihdr, byte(depth), 4, 0, 0, 0)
+	row := []byte{0} // No filter.
+	if depth == 16 {
+		row = binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(row, gray), alpha)
+	} else {
+		row = append(row, byte(gray), byte(alpha))
+	}
+	var idat bytes.Buffer
+	zw := zlib.NewWriter(&idat)
+	zw.Write(row)
+	zw.Close()
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = append(data, pngChunk("IHDR", ihdr)...)
+	data = append(data, pngChunk("IDAT", idat.Bytes())...)
+	return append(data, pngChunk("IEND", nil)...)
+}
+
+// adobeCMYKJPEG encodes an 8x8 JPEG of a single CMYK colour the way Adobe
+// applications do: with an APP14 "Adobe" segment and inverted channels,
+// where 255 means no ink. The standard library can decode but not encode
+// CMYK. Every block holds only a DC coefficient, so the colour is exact.
+func adobeCMYKJPEG(ink [4]uint8) []byte {
+	segment := func(marker byte, payload []byte) []byte {
+		return append(binary.BigEndian.AppendUint16([]byte{0xff, marker}, uint16(len(payload)+2)), payload...)
+	}
+	data := []byte{0xff, 0xd8}
+	data = append(data, segment(0xee, []byte("Adobe\x00\x64\x00\x00\x00\x00\x00"))...) // Transform 0: CMYK.
+	data = append(data, segment(0xdb, append([]byte{0}, bytes.Repeat([]byte{1}, 64)...))...)
+	sof := []byte{8, 0, 8, 0, 8, 4}
+	sos := []byte{4}
+	for id := byte(1); id <= 4; id++ {
+		sof = append(sof, id, 0x11, 0)
+		sos = append(sos, id, 0)
+	}
+	data = append(data, segment(0xc0, sof)...)
+	// DC codes are the 4-bit size category; the only AC code, 0, ends the block.
+	dht := append([]byte{0x00}, make([]byte, 16)...)
+	dht[4] = 12
+	dht = append(dht, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+	dht = append(dht, append([]byte{0x10, 1}, make([]byte, 15)...)...)
+	dht = append(dht, 0)
+	data = append(data, segment(0xc4, dht)...)
+	data = append(data, segment(0xda, append(sos, 0, 63, 0))...)
+
+	var acc uint64
+	var n uint
+	var scan []byte
+	put := func(v uint64, bits uint) {
+		acc, n = acc<<bits|v&(1<<bits-1), n+bits
+		for n >= 8 {
+			b := byte(acc >> (n - 8))
+			if scan = append(scan, b); b == 0xff {
+				scan = append(scan, 0)
+			}
+			n -= 8
+		}
+	}
+	for _, v := range ink {
+		dc := (int(255-v) - 128) * 8
+		size := uint(bits.Len(uint(max(dc, -dc))))
+		put(uint64(size), 4)
+		if dc < 0 {
+			dc += 1<<size - 1
+		}
+		put(uint64(dc), size)
+		put(0, 1)
+	}
+	put(0xff, (8-n)%8)
+	data = append(data, scan...)
+	return append(data, 0xff, 0xd9)
+}
+
+func TestConvert_ColourModels(t *testing.T) {
+	rect := image.Rect(0, 0, 1, 1)
+	encode := func(img image.Image, set color.Color, tiffFormat bool) []byte {
+		img.(interface{ Set(x, y int, c color.Color) }).Set(0, 0, set)
+		var buf bytes.Buffer
+		if tiffFormat {
+			tiff.Encode(&buf, img, nil)
+		} else {
+			png.Encode(&buf, img)
+		}
+		return buf.Bytes()
+	}
+	// 0x12ff is 18.996 in 8 bits, which truncation turns into 18.
+	semi := color.NRGBA64{R: 0x12ff, G: 0x4000, B: 0x8000, A: 0x8080}
+	opaque := color.NRGBA64{R: 0x12ff, G: 0x4000, B: 0x8000, A: 0xffff}
+
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		model string // The type the fixture decodes to.
+		want  color.NRGBA
+	}{
+		{"16-bit PNG with alpha", encode(image.NewNRGBA64(rect), semi, false), "*image.NRGBA64", color.NRGBA{19, 64, 128, 128}},
+		{"16-bit opaque PNG", encode(image.NewRGBA64(rect), opaque, false), "*image.RGBA64", color.NRGBA{19, 64, 128, 255}},
+		{"16-bit premultiplied TIFF", encode(image.NewRGBA64(rect), semi, true), "*image.RGBA64", color.NRGBA{19, 64, 128, 128}},
+		{"16-bit gray PNG", encode(image.NewGray16(rect), color.Gray16{Y: 0x12ff}, false), "*image.Gray16", color.NRGBA{19, 19, 19, 255}},
+		{"gray+alpha PNG", grayAlphaPNG(8, 200, 100), "*image.NRGBA", color.NRGBA{200, 200, 200, 100}},
+		{"16-bit gray+alpha PNG", grayAlphaPNG(16, 0x12ff, 0x8080), "*image.NRGBA64", color.NRGBA{19, 19, 19, 128}},
+		{"Adobe CMYK JPEG", adobeCMYKJPEG([4]uint8{0, 128, 255, 64}), "*image.CMYK", color.NRGBA{191, 95, 0, 255}},
+		{"Adobe CMYK JPEG red", adobeCMYKJPEG([4]uint8{0, 255, 255, 0}), "*image.CMYK", color.NRGBA{255, 0, 0, 255}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img, _, err := image.Decode(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatalf("Fixture does not decode: %v", err)
+			}
+			if model := fmt.Sprintf("%T", img); model != tc.model {
+				t.Fatalf("Fixture decodes to %s, expected %s", model, tc.model)
+			}
+
+			data, _, err := converter.ConvertBytes(tc.data, converter.Options{Encoder: converter.EncoderVP8L})
+			if err != nil {
+				t.Fatalf("ConvertBytes failed: %v", err)
+			}
+			out, err := webp.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Output is not a WebP image: %v", err)
+			}
+			if got := color.NRGBAModel.Convert(out.At(0, 0)); got != tc.want {
+				t.Errorf("Pixel is %v, expected %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+	"strings"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// Output formats accepted by Options.Format and EncoderFor.
+const (
+	FormatWebP = "webp"
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+)
+
+// WebP encoder backends selectable through Options.Encoder.
+const (
+	// EncoderChai2010 uses libwebp through github.com/chai2010/webp. It
+	// supports lossy and lossless encoding but is only available in cgo builds.
+	EncoderChai2010 = "chai2010"
+	// EncoderVP8L uses the pure-Go encoder in internal/vp8l. It only writes
+	// lossless WebP but is available in every build, including cgo-free ones.
+	EncoderVP8L = "vp8l"
+)
+
+// Encoder writes images in a single output format.
+type Encoder interface {
+	// Encode writes img to w, honouring the quality settings in opts that
+	// apply to the format.
+	Encode(w io.Writer, img image.Image, opts Options) error
+	// Extension returns the file extension for the format, including the leading dot.
+	Extension() string
+	// MIMEType returns the media type of the format.
+	MIMEType() string
+}
+
+// EncoderFor returns the encoder for the named output format. The format
+// name is case-insensitive and "jpg" is accepted as an alias for "jpeg".
+// An empty name selects WebP.
+func EncoderFor(format string) (Encoder, error) {
+	switch strings.ToLower(format) {
+	case "", FormatWebP:
+		return webpEncoder{}, nil
+	case FormatPNG:
+		return pngEncoder{}, nil
+	case FormatJPEG, "jpg":
+		return jpegEncoder{}, nil
+	}
+	return nil, fmt.Errorf("unsupported output format %q, expected webp, png or jpeg", format)
+}
+
+// webpEncoders returns the WebP encoder backends compiled into this binary, keyed by name.
+func webpEncoders() map[string]Encoder {
+	encoders := map[string]Encoder{EncoderVP8L: vp8lEncoder{}}
+	for name, enc := range cgoWebPEncoders() {
+		encoders[name] = enc
+	}
+	return encoders
+}
+
+// WebPEncoderNames returns the names of the WebP encoder backends available
+// in this build, sorted alphabetically.
+func WebPEncoderNames() []string {
+	var names []string
+	for name := range webpEncoders() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultWebPEncoder returns the name of the backend used when Options.Encoder
+// is empty: chai2010 when cgo is available, since it also supports lossy
+// output, and vp8l otherwise.
+func DefaultWebPEncoder() string {
+	if _, ok := webpEncoders()[EncoderChai2010]; ok {
+		return EncoderChai2010
+	}
+	return EncoderVP8L
+}
+
+// WebPEncoder returns the WebP encoder backend with the given name. An empty
+// name selects DefaultWebPEncoder.
+func WebPEncoder(name string) (Encoder, error) {
+	if name == "" {
+		name = DefaultWebPEncoder()
+	}
+	enc, ok := webpEncoders()[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown WebP encoder %q, available: %s", name, strings.Join(WebPEncoderNames(), ", "))
+	}
+	return enc, nil
+}
+
+// UsesQuality reports whether the output format and WebP mode selected by
+// opts are lossy, so that Options.Quality affects the output.
+func UsesQuality(opts Options) bool {
+	enc, err := EncoderFor(opts.Format)
+	return err == nil && usesQuality(enc, opts)
+}
+
+// usesQuality reports whether the output of enc depends on Options.Quality.
+func usesQuality(enc Encoder, opts Options) bool {
+	switch enc.(type) {
+	case jpegEncoder:
+		return true
+	case webpEncoder:
+		if opts.Lossless {
+			return false
+		}
+		backend, err := WebPEncoder(opts.Encoder)
+		_, lossless := backend.(vp8lEncoder)
+		return err == nil && !lossless
+	}
+	return false
+}
+
+// decodeOutput decodes data produced by enc.
+func decodeOutput(enc Encoder, data []byte) (image.Image, error) {
+	r := bytes.NewReader(data)
+	switch enc.MIMEType() {
+	case "image/png":
+		return png.Decode(r)
+	case "image/jpeg":
+		return jpeg.Decode(r)
+	case "image/webp":
+		return xwebp.Decode(r)
+	}
+	return nil, fmt.Errorf("no decoder for %s", enc.MIMEType())
+}
+
+// webpEncoder encodes WebP with the backend selected by Options.Encoder.
+type webpEncoder struct{}
+
+func (webpEncoder) Encode(w io.Writer, img image.Image, opts Options) error {
+	backend, err := WebPEncoder(opts.Encoder)
+	if err != nil {
+		return err
+	}
+	if opts.AlphaQuality > 0 && usesQuality(webpEncoder{}, opts) {
+		img = quantizeAlpha(img, opts.AlphaQuality)
+	}
+	return backend.Encode(w, img, opts)
+}
+
+func (webpEncoder) Extension() string { return ".webp" }
+func (webpEncoder) MIMEType() string  { return "image/webp" }
+
+// pngEncoder encodes PNG. PNG is always lossless, so quality settings are ignored.
+type pngEncoder struct{}
+
+func (pngEncoder) Encode(w io.Writer, img image.Image, _ Options) error {
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	return enc.Encode(w, img)
+}
+
+func (pngEncoder) Extension() string { return ".png" }
+func (pngEncoder) MIMEType() string  { return "image/png" }
+
+// jpegEncoder encodes baseline JPEG at the configured quality. JPEG has no
+// alpha channel, so transparent areas are flattened onto white.
+type jpegEncoder struct{}
+
+func (jpegEncoder) Encode(w io.Writer, img image.Image, opts Options) error {
+	return jpeg.Encode(w, flatten(img, color.White), &jpeg.Options{Quality: int(opts.quality())})
+}
+
+func (jpegEncoder) Extension() string { return ".jpg" }
+func (jpegEncoder) MIMEType() string  { return "image/jpeg" }
@@ -0,0 +1,93 @@
+package converter
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// ssimWindow is the side of the square windows SSIM is computed over.
+	ssimWindow = 8
+	// ssimStride is the distance between neighbouring SSIM windows.
+	ssimStride = 4
+)
+
+// SSIM returns the mean structural similarity of the luma of a and b,
+// computed over overlapping 8x8 windows. It is 1 for identical images and
+// lower the more they differ. Both images must have the same size.
+func SSIM(a, b image.Image) float64 {
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	la, lb := luma(a), luma(b)
+
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	winW, winH := min(ssimWindow, width), min(ssimWindow, height)
+	var total float64
+	var windows int
+	for y0 := 0; y0+winH <= height; y0 += ssimStride {
+		for x0 := 0; x0+winW <= width; x0 += ssimStride {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := y0; y < y0+winH; y++ {
+				for x := x0; x < x0+winW; x++ {
+					pa, pb := la[y*width+x], lb[y*width+x]
+					sumA += pa
+					sumB += pb
+					sumAA += pa * pa
+					sumBB += pb * pb
+					sumAB += pa * pb
+				}
+			}
+			n := float64(winW * winH)
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			covar := sumAB/n - meanA*meanB
+			total += (2*meanA*meanB + c1) * (2*covar + c2) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	return total / float64(windows)
+}
+
+// PSNR returns the peak signal-to-noise ratio in decibels between the RGB
+// channels of a and b, or +Inf if they are identical. Both images must have
+// the same size.
+func PSNR(a, b image.Image) float64 {
+	ba, bb := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := 0; y < ba.Dy(); y++ {
+		for x := 0; x < ba.Dx(); x++ {
+			ra, ga, blA, _ := a.At(ba.Min.X+x, ba.Min.Y+y).RGBA()
+			rb, gb, blB, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range [3]float64{
+				float64(ra>>8) - float64(rb>>8),
+				float64(ga>>8) - float64(gb>>8),
+				float64(blA>>8) - float64(blB>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+	if sum == 0 {
+		return math.Inf(1)
+	}
+	mse := sum / float64(3*ba.Dx()*ba.Dy())
+	return 10 * math.Log10(255*255/mse)
+}
+
+// luma returns the BT.601 luma of every pixel of img in row-major order.
+// Colours are taken premultiplied, so transparent areas count as black.
+func luma(img image.Image) []float64 {
+	bounds := img.Bounds()
+	out := make([]float64, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			out = append(out, (0.299*float64(r)+0.587*float64(g)+0.114*float64(b))/257)
+		}
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package converter
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+)
+
+const (
+	// minTargetQuality is the lowest quality tried when searching for a
+	// quality that fits Options.TargetSize.
+	minTargetQuality = 1
+	// maxQuality is the highest quality the encoders accept.
+	maxQuality = 100
+	// targetDownscaleStep is the factor each dimension is scaled by per
+	// downscaling attempt when the lowest quality is still too large.
+	targetDownscaleStep = 0.75
+)
+
+// encodeToSize encodes img with the highest quality, up to opts.Quality,
+// whose output fits within opts.TargetSize bytes. If the image does not fit
+// even at the lowest quality, it is downscaled in steps and searched again.
+func encodeToSize(enc Encoder, img image.Image, opts Options) (encoded, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scaled := img
+	for scale := 1.0; ; scale *= targetDownscaleStep {
+		if scale < 1 {
+			newWidth := max(1, int(math.Round(float64(width)*scale)))
+			newHeight := max(1, int(math.Round(float64(height)*scale)))
+			prev := scaled.Bounds()
+			if newWidth == prev.Dx() && newHeight == prev.Dy() {
+				break
+			}
+			scaled = resize(img, newWidth, newHeight)
+		}
+
+		out, fits, err := searchQuality(enc, scaled, opts)
+		if err != nil {
+			return encoded{}, err
+		}
+		if fits {
+			return out, nil
+		}
+		if scaled.Bounds().Dx() == 1 && scaled.Bounds().Dy() == 1 {
+			break
+		}
+	}
+	return encoded{}, fmt.Errorf("cannot fit the image within %d bytes, even downscaled at the lowest quality", opts.TargetSize)
+}
+
+// searchQuality binary-searches the highest integer quality between
+// minTargetQuality and opts.Quality whose output fits opts.TargetSize. It
+// reports false if no quality fits. Encoders that ignore quality are
+// encoded once.
+func searchQuality(enc Encoder, img image.Image, opts Options) (encoded, bool, error) {
+	if !usesQuality(enc, opts) {
+		data, err := encodeAt(enc, img, opts, opts.quality())
+		if err != nil {
+			return encoded{}, false, err
+		}
+		return encoded{data: data, img: img}, int64(len(data)) <= opts.TargetSize, nil
+	}
+
+	// Most images fit at the requested quality, so try it before searching.
+	var best encoded
+	found := false
+	lo, hi := minTargetQuality, max(minTargetQuality, int(opts.quality()))
+	for quality := hi; lo <= hi; quality = (lo + hi) / 2 {
+		data, err := encodeAt(enc, img, opts, float32(quality))
+		if err != nil {
+			return encoded{}, false, err
+		}
+		slog.Debug("Tried quality for target size", "quality", quality, "width", img.Bounds().Dx(), "height", img.Bounds().Dy(),
+			"bytes", len(data), "target_bytes", opts.TargetSize)
+		if int64(len(data)) <= opts.TargetSize {
+			best, found = encoded{data: data, img: img, quality: float32(quality)}, true
+			lo = quality + 1
+		} else {
+			hi = quality - 1
+		}
+	}
+	return best, found, nil
+}
+
+// encodeToSimilarity encodes img with the lowest quality whose decoded output
+// reaches opts.TargetSSIM or opts.TargetPSNR. If no quality does, the image
+// is encoded at the highest quality and the shortfall is left visible in the
+// reported metric.
+func encodeToSimilarity(enc Encoder, img image.Image, opts Options) (encoded, error) {
+	measure := func(quality float32) (encoded, bool, error) {
+		data, err := encodeAt(enc, img, opts, quality)
+		if err != nil {
+			return encoded{}, false, err
+		}
+		decoded, err := decodeOutput(enc, data)
+		if err != nil {
+			return encoded{}, false, fmt.Errorf("failed to decode own output: %w", err)
+		}
+		out := encoded{data: data, img: img, quality: quality}
+		if opts.TargetSSIM > 0 {
+			out.ssim = SSIM(img, decoded)
+			slog.Debug("Tried quality for target SSIM", "quality", quality, "ssim", out.ssim, "target_ssim", opts.TargetSSIM)
+			return out, out.ssim >= opts.TargetSSIM, nil
+		}
+		out.psnr = PSNR(img, decoded)
+		slog.Debug("Tried quality for target PSNR", "quality", quality, "psnr", out.psnr, "target_psnr", opts.TargetPSNR)
+		return out, out.psnr >= opts.TargetPSNR, nil
+	}
+
+	if !usesQuality(enc, opts) {
+		out, _, err := measure(opts.quality())
+		out.quality = 0
+		return out, err
+	}
+
+	var best, highest encoded
+	found := false
+	lo, hi := minTargetQuality, maxQuality
+	for lo <= hi {
+		quality := (lo + hi) / 2
+		out, ok, err := measure(float32(quality))
+		if err != nil {
+			return encoded{}, err
+		}
+		if quality == maxQuality {
+			highest = out
+		}
+		if ok {
+			best, found = out, true
+			hi = quality - 1
+		} else {
+			lo = quality + 1
+		}
+	}
+	if !found {
+		return highest, nil
+	}
+	return best, nil
+}
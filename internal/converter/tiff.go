@@ -0,0 +1,97 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+
+	"golang.org/x/image/tiff"
+)
+
+const (
+	tiffLittleEndianHeader = "II\x2A\x00"
+	tiffBigEndianHeader    = "MM\x00\x2A"
+
+	// tiffMaxPages guards against IFD chains that loop back on themselves.
+	tiffMaxPages = 10000
+)
+
+// IsTIFF reports whether header starts with a TIFF byte-order mark.
+func IsTIFF(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(tiffLittleEndianHeader)) || bytes.HasPrefix(header, []byte(tiffBigEndianHeader))
+}
+
+// TIFFPageCount returns the number of pages (image file directories) in the TIFF file at path.
+func TIFFPageCount(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read TIFF file %s: %w", path, err)
+	}
+	offsets, err := tiffPageOffsets(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read TIFF pages of %s: %w", path, err)
+	}
+	return len(offsets), nil
+}
+
+// tiffPageOffsets walks the IFD chain of a TIFF file and returns the offset of every page's IFD.
+func tiffPageOffsets(data []byte) ([]uint32, error) {
+	if !IsTIFF(data) || len(data) < 8 {
+		return nil, errors.New("not a TIFF file")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	var offsets []uint32
+	seen := make(map[uint32]bool)
+	for offset := order.Uint32(data[4:8]); offset != 0; {
+		if seen[offset] || len(offsets) >= tiffMaxPages {
+			return nil, errors.New("IFD chain loops")
+		}
+		seen[offset] = true
+		if int64(offset)+2 > int64(len(data)) {
+			return nil, fmt.Errorf("IFD offset %d out of range", offset)
+		}
+		entries := int64(order.Uint16(data[offset : offset+2]))
+		next := int64(offset) + 2 + entries*12
+		if next+4 > int64(len(data)) {
+			return nil, fmt.Errorf("IFD at offset %d is truncated", offset)
+		}
+		offsets = append(offsets, offset)
+		offset = order.Uint32(data[next : next+4])
+	}
+	if len(offsets) == 0 {
+		return nil, errors.New("TIFF file has no pages")
+	}
+	return offsets, nil
+}
+
+// decodeTIFFPage decodes the given zero-based page of a TIFF file.
+// golang.org/x/image/tiff only ever reads the first IFD, so the header's
+// first-IFD offset is rewritten to point at the requested page instead.
+func decodeTIFFPage(data []byte, page int) (image.Image, error) {
+	offsets, err := tiffPageOffsets(data)
+	if err != nil {
+		return nil, err
+	}
+	if page < 0 || page >= len(offsets) {
+		return nil, fmt.Errorf("page %d out of range, file has %d page(s)", page+1, len(offsets))
+	}
+	if page == 0 {
+		return tiff.Decode(bytes.NewReader(data))
+	}
+
+	patched := make([]byte, len(data))
+	copy(patched, data)
+	if data[0] == 'M' {
+		binary.BigEndian.PutUint32(patched[4:8], offsets[page])
+	} else {
+		binary.LittleEndian.PutUint32(patched[4:8], offsets[page])
+	}
+	return tiff.Decode(bytes.NewReader(patched))
+}
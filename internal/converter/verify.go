@@ -0,0 +1,61 @@
+package converter
+
+import (
+	"fmt"
+	"os"
+)
+
+// Verification describes an output checked by Verify.
+type Verification struct {
+	Width, Height int
+	// PSNR is the output's PSNR against the source in decibels, or zero if
+	// it was not computed.
+	PSNR float64
+}
+
+// Verify decodes outputFile, written by Convert from inputFile with opts,
+// and checks that it has the dimensions the source should have been scaled
+// to: exactly those set by opts.MaxWidth and opts.MaxHeight, or no larger
+// when opts.TargetSize may have downscaled it further. If computePSNR is
+// set, it also measures the output's PSNR against the source scaled to the
+// same size.
+func Verify(inputFile, outputFile string, opts Options, computePSNR bool) (Verification, error) {
+	enc, err := EncoderFor(opts.Format)
+	if err != nil {
+		return Verification{}, err
+	}
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		return Verification{}, fmt.Errorf("failed to read %s: %w", outputFile, err)
+	}
+	out, err := decodeOutput(enc, data)
+	if err != nil {
+		return Verification{}, fmt.Errorf("failed to decode %s as %s: %w", outputFile, enc.MIMEType(), err)
+	}
+	v := Verification{Width: out.Bounds().Dx(), Height: out.Bounds().Dy()}
+
+	src, _, err := decodeFile(inputFile, opts)
+	if err != nil {
+		return v, err
+	}
+	if opts.Background != nil {
+		src = flatten(src, opts.Background)
+	}
+	wantWidth, wantHeight := FitSize(src.Bounds().Dx(), src.Bounds().Dy(), opts.MaxWidth, opts.MaxHeight)
+	if opts.TargetSize > 0 {
+		if v.Width > wantWidth || v.Height > wantHeight {
+			return v, fmt.Errorf("output is %dx%d, larger than the expected %dx%d", v.Width, v.Height, wantWidth, wantHeight)
+		}
+	} else if v.Width != wantWidth || v.Height != wantHeight {
+		return v, fmt.Errorf("output is %dx%d, expected %dx%d", v.Width, v.Height, wantWidth, wantHeight)
+	}
+
+	if computePSNR {
+		ref := src
+		if b := src.Bounds(); b.Dx() != v.Width || b.Dy() != v.Height {
+			ref = scaleTo(src, v.Width, v.Height)
+		}
+		v.PSNR = PSNR(ref, out)
+	}
+	return v, nil
+}
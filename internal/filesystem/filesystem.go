@@ -3,6 +3,7 @@ package filesystem
 import (
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 )
@@ -48,11 +49,9 @@ func FindFiles(inputPath string) ([]string, error) {
 		if walkErr != nil {
 			// Skip files that cause errors (e.g. permission issues)
 			// This error is from the function passed to WalkDir.
-			// We want to collect files even if some paths are inaccessible.
-			// So, we log it (or could add to a list of errors) and continue.
-			// For now, just returning nil to continue the walk.
-			// If we wanted to signal this up, we'd need a different mechanism.
-			// fmt.Printf("Warning: error accessing %s: %v\n", path, walkErr) // Example logging
+			// We want to collect files even if some paths are inaccessible,
+			// so we log it and continue.
+			slog.Warn("Skipping inaccessible path", "path", path, "error", walkErr)
 			return nil // Continue walking even if a path is problematic.
 		}
 
@@ -63,13 +62,13 @@ func FindFiles(inputPath string) ([]string, error) {
 		} else if entryType&fs.ModeSymlink != 0 {
 			resolvedPath, errEval := filepath.EvalSymlinks(path)
 			if errEval != nil {
-				// fmt.Printf("Warning: error evaluating symlink %s: %v\n", path, errEval)
+				slog.Warn("Skipping broken symlink", "path", path, "error", errEval)
 				return nil // Skip broken or problematic symlinks
 			}
 			// Check if the resolved path points to a regular file
 			resolvedInfo, errStat := os.Stat(resolvedPath)
 			if errStat != nil {
-				// fmt.Printf("Warning: error stating resolved symlink %s (target %s): %v\n", path, resolvedPath, errStat)
+				slog.Warn("Skipping symlink with inaccessible target", "path", path, "target", resolvedPath, "error", errStat)
 				return nil // Skip if cannot stat resolved path
 			}
 			if resolvedInfo.Mode().IsRegular() {
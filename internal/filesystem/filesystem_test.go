@@ -1,10 +1,13 @@
 package filesystem_test
 
 import (
+	"bytes"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"imageconverter/internal/filesystem"
@@ -146,3 +149,26 @@ func TestFindFiles_SingleSymlinkToFile(t *testing.T) {
 		t.Errorf("Expected FindFiles to return %v for symlink, got %v", expected, files)
 	}
 }
+
+func TestFindFiles_BrokenSymlinkIsLogged(t *testing.T) {
+	tmpDir := t.TempDir()
+	brokenPath := filepath.Join(tmpDir, "broken.txt")
+	if err := os.Symlink(filepath.Join(tmpDir, "missing.txt"), brokenPath); err != nil {
+		t.Skipf("Skipping symlink test: could not create symlink: %v", err)
+	}
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	files, err := filesystem.FindFiles(tmpDir)
+	if err != nil {
+		t.Fatalf("FindFiles returned an error: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected no files, got %v", files)
+	}
+	if !strings.Contains(logs.String(), "level=WARN msg=\"Skipping broken symlink\" path="+brokenPath) {
+		t.Errorf("Missing warning for the broken symlink in %q", logs.String())
+	}
+}
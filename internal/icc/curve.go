@@ -0,0 +1,114 @@
+package icc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// curve is a tone reproduction curve, which maps an encoded channel value
+// from 0 to 1 to a linear one.
+type curve struct {
+	// table, if set, samples the curve at evenly spaced inputs and is
+	// interpolated linearly.
+	table []float64
+	// Otherwise the curve is the parametric function of the given type,
+	// 0 to 4, as defined for the ICC "para" tag: y = x^g for type 0, up
+	// to a power segment and a linear one with offsets for type 4.
+	funcType            int
+	g, a, b, c, d, e, f float64
+}
+
+// srgbCurve is the sRGB transfer function.
+var srgbCurve = curve{funcType: 3, g: 2.4, a: 1 / 1.055, b: 0.055 / 1.055, c: 1 / 12.92, d: 0.04045}
+
+// paramCounts is the number of parameters of each parametric curve type.
+var paramCounts = [...]int{1, 3, 4, 5, 7}
+
+// parseCurve parses a "curv" or "para" tag.
+func parseCurve(tag []byte) (curve, error) {
+	if len(tag) < 12 {
+		return curve{}, errors.New("truncated")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := binary.BigEndian.Uint32(tag[8:12])
+		if int64(n)*2 > int64(len(tag)-12) {
+			return curve{}, errors.New("truncated")
+		}
+		switch n {
+		case 0:
+			return curve{g: 1}, nil
+		case 1:
+			return curve{g: float64(binary.BigEndian.Uint16(tag[12:14])) / 256}, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+		}
+		return curve{table: table}, nil
+	case "para":
+		funcType := int(binary.BigEndian.Uint16(tag[8:10]))
+		if funcType >= len(paramCounts) {
+			return curve{}, fmt.Errorf("unknown parametric curve type %d", funcType)
+		}
+		if len(tag) < 12+paramCounts[funcType]*4 {
+			return curve{}, errors.New("truncated")
+		}
+		var params [7]float64
+		for i := range paramCounts[funcType] {
+			params[i] = s15Fixed16(tag[12+i*4:])
+		}
+		c := curve{funcType: funcType, g: params[0], a: params[1], b: params[2], c: params[3], d: params[4], e: params[5], f: params[6]}
+		if funcType > 0 && c.a == 0 {
+			return curve{}, errors.New("parametric curve with a zero slope")
+		}
+		return c, nil
+	}
+	return curve{}, fmt.Errorf("unknown curve type %q", tag[:4])
+}
+
+// eval returns the linear value of the encoded value x, both from 0 to 1.
+func (c curve) eval(x float64) float64 {
+	if c.table != nil {
+		pos := x * float64(len(c.table)-1)
+		i := min(int(pos), len(c.table)-2)
+		return c.table[i] + (c.table[i+1]-c.table[i])*(pos-float64(i))
+	}
+	var y float64
+	switch c.funcType {
+	case 0:
+		y = math.Pow(x, c.g)
+	case 1:
+		if x >= -c.b/c.a {
+			y = math.Pow(c.a*x+c.b, c.g)
+		}
+	case 2:
+		y = c.c
+		if x >= -c.b/c.a {
+			y += math.Pow(c.a*x+c.b, c.g)
+		}
+	case 3:
+		y = c.c * x
+		if x >= c.d {
+			y = math.Pow(c.a*x+c.b, c.g)
+		}
+	case 4:
+		y = c.c*x + c.f
+		if x >= c.d {
+			y = math.Pow(c.a*x+c.b, c.g) + c.e
+		}
+	}
+	return min(max(y, 0), 1)
+}
+
+// sample returns the linear values of the n evenly spaced encoded values
+// from 0 to 1.
+func (c curve) sample(n int) []float32 {
+	t := make([]float32, n)
+	for i := range t {
+		t[i] = float32(c.eval(float64(i) / float64(n-1)))
+	}
+	return t
+}
@@ -0,0 +1,159 @@
+package icc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+)
+
+// jpegICCMarker starts the APP2 segments that carry an ICC profile in JPEG
+// files. Profiles larger than a segment are split across several.
+const jpegICCMarker = "ICC_PROFILE\x00"
+
+// tiffICCTag is the TIFF tag that holds an ICC profile.
+const tiffICCTag = 34675
+
+// Extract returns the ICC profile embedded in a JPEG, PNG, WebP or TIFF
+// file, or nil if it has none or it cannot be read. For multi-page TIFF
+// files the profile of the first page is returned.
+func Extract(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		return fromJPEG(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return fromPNG(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return fromWebP(data)
+	case bytes.HasPrefix(data, []byte("II\x2a\x00")) || bytes.HasPrefix(data, []byte("MM\x00\x2a")):
+		return fromTIFF(data)
+	}
+	return nil
+}
+
+// fromJPEG joins the ICC segments of a JPEG file in sequence order.
+func fromJPEG(data []byte) []byte {
+	var chunks [][]byte
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return nil
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xff: // Fill byte.
+			pos++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7: // No length.
+			pos += 2
+			continue
+		case marker == 0xda || marker == 0xd9: // Image data or end of image.
+			pos = len(data)
+			continue
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			return nil
+		}
+		if payload := data[pos+4 : end]; marker == 0xe2 && bytes.HasPrefix(payload, []byte(jpegICCMarker)) && len(payload) >= len(jpegICCMarker)+2 {
+			seq, count := int(payload[len(jpegICCMarker)]), int(payload[len(jpegICCMarker)+1])
+			if chunks == nil {
+				chunks = make([][]byte, count)
+			}
+			if seq < 1 || seq > len(chunks) || count != len(chunks) {
+				return nil
+			}
+			chunks[seq-1] = payload[len(jpegICCMarker)+2:]
+		}
+		pos = end
+	}
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+// fromPNG decompresses the iCCP chunk of a PNG file.
+func fromPNG(data []byte) []byte {
+	for pos := 8; pos+8 <= len(data); {
+		length := int64(binary.BigEndian.Uint32(data[pos:]))
+		kind := string(data[pos+4 : pos+8])
+		if int64(pos)+12+length > int64(len(data)) || kind == "IDAT" {
+			return nil
+		}
+		if kind == "iCCP" {
+			// A profile name, a NUL, the compression method (always zlib)
+			// and the compressed profile.
+			payload := data[pos+8 : pos+8+int(length)]
+			name := bytes.IndexByte(payload, 0)
+			if name < 0 || name+2 > len(payload) {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(payload[name+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		pos += 12 + int(length)
+	}
+	return nil
+}
+
+// fromWebP returns the ICCP chunk of an extended WebP file.
+func fromWebP(data []byte) []byte {
+	for pos := 12; pos+8 <= len(data); {
+		size := int64(binary.LittleEndian.Uint32(data[pos+4:]))
+		if int64(pos)+8+size > int64(len(data)) {
+			return nil
+		}
+		if string(data[pos:pos+4]) == "ICCP" {
+			return data[pos+8 : pos+8+int(size)]
+		}
+		pos += 8 + int(size) + int(size&1)
+	}
+	return nil
+}
+
+// fromTIFF returns the ICC profile tag of the first IFD of a TIFF file.
+func fromTIFF(data []byte) []byte {
+	if len(data) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	ifd := int64(order.Uint32(data[4:8]))
+	if ifd+2 > int64(len(data)) {
+		return nil
+	}
+	entries := int64(order.Uint16(data[ifd:]))
+	for i := range entries {
+		entry := ifd + 2 + i*12
+		if entry+12 > int64(len(data)) {
+			return nil
+		}
+		if order.Uint16(data[entry:]) != tiffICCTag {
+			continue
+		}
+		// The values are bytes, stored in the entry itself if they fit.
+		count := int64(order.Uint32(data[entry+4:]))
+		offset := entry + 8
+		if count > 4 {
+			offset = int64(order.Uint32(data[entry+8:]))
+		}
+		if offset+count > int64(len(data)) {
+			return nil
+		}
+		return data[offset : offset+count]
+	}
+	return nil
+}
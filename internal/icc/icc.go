@@ -0,0 +1,144 @@
+// Package icc reads the ICC colour profiles embedded in images and converts
+// pixels from RGB matrix/TRC profiles, such as Adobe RGB and Display P3, to
+// sRGB.
+//
+// A matrix/TRC profile describes each channel with a tone reproduction
+// curve, which makes it linear, and a matrix, which maps linear RGB to the
+// CIE XYZ profile connection space. Profiles built from lookup tables, and
+// CMYK and grayscale profiles, are not supported.
+package icc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf16"
+)
+
+// Profile is a parsed RGB matrix/TRC profile.
+type Profile struct {
+	// Description is the profile's name, such as "Adobe RGB (1998)", or
+	// empty if it has none.
+	Description string
+	// toXYZ maps linear RGB to D50 XYZ. Its columns are the red, green and
+	// blue colorants.
+	toXYZ  matrix
+	curves [3]curve // Red, green and blue tone reproduction curves.
+}
+
+// ErrUnsupported is returned by Parse for valid profiles it cannot convert
+// from.
+var ErrUnsupported = errors.New("unsupported ICC profile")
+
+// Parse parses an ICC profile. It returns an error wrapping ErrUnsupported
+// if the profile is not an RGB matrix/TRC profile.
+func Parse(data []byte) (*Profile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	if space := string(data[16:20]); space != "RGB " {
+		return nil, fmt.Errorf("%w: colour space %q", ErrUnsupported, space)
+	}
+	if pcs := string(data[20:24]); pcs != "XYZ " {
+		return nil, fmt.Errorf("%w: connection space %q", ErrUnsupported, pcs)
+	}
+
+	tags := make(map[string][]byte)
+	count := binary.BigEndian.Uint32(data[128:132])
+	if int64(count)*12 > int64(len(data)-132) {
+		return nil, errors.New("truncated tag table")
+	}
+	for i := range int(count) {
+		entry := data[132+i*12:]
+		offset, size := binary.BigEndian.Uint32(entry[4:8]), binary.BigEndian.Uint32(entry[8:12])
+		if int64(offset)+int64(size) > int64(len(data)) {
+			return nil, fmt.Errorf("tag %q out of range", entry[:4])
+		}
+		tags[string(entry[:4])] = data[offset : offset+size]
+	}
+
+	p := &Profile{Description: parseDescription(tags["desc"])}
+	for i, name := range []string{"r", "g", "b"} {
+		xyz, ok := tags[name+"XYZ"]
+		trc, ok2 := tags[name+"TRC"]
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("%w: no %sXYZ and %sTRC tags", ErrUnsupported, name, name)
+		}
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("invalid %sXYZ tag", name)
+		}
+		for j := range 3 {
+			p.toXYZ[j][i] = s15Fixed16(xyz[8+j*4:])
+		}
+		c, err := parseCurve(trc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sTRC tag: %w", name, err)
+		}
+		p.curves[i] = c
+	}
+	if _, ok := p.toXYZ.invert(); !ok {
+		return nil, errors.New("colorants are not linearly independent")
+	}
+	return p, nil
+}
+
+// IsSRGB reports whether p describes sRGB, within the rounding of the
+// profiles in common use, so that converting from it would change nothing.
+func (p *Profile) IsSRGB() bool {
+	for i := range 3 {
+		for j := range 3 {
+			if math.Abs(p.toXYZ[i][j]-srgbToXYZ[i][j]) > 0.003 {
+				return false
+			}
+		}
+	}
+	for _, c := range p.curves {
+		for x := 0.0; x <= 1; x += 1.0 / 32 {
+			if math.Abs(c.eval(x)-srgbCurve.eval(x)) > 0.5/255 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// s15Fixed16 decodes a signed 15.16 fixed-point number.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseDescription returns the text of a profile description tag, in the
+// ICC v2 "desc" or v4 "mluc" form, or an empty string.
+func parseDescription(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := binary.BigEndian.Uint32(tag[8:12])
+		if int64(n) > int64(len(tag)-12) {
+			return ""
+		}
+		text := tag[12 : 12+n]
+		for len(text) > 0 && text[len(text)-1] == 0 {
+			text = text[:len(text)-1]
+		}
+		return string(text)
+	case "mluc":
+		// Use the first record, whatever its language.
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:12]) == 0 {
+			return ""
+		}
+		n, offset := binary.BigEndian.Uint32(tag[20:24]), binary.BigEndian.Uint32(tag[24:28])
+		if int64(offset)+int64(n) > int64(len(tag)) {
+			return ""
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[int(offset)+i*2:])
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
@@ -0,0 +1,250 @@
+package icc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// Colorants of common profiles, as the columns of their D50 XYZ matrices.
+var (
+	srgbColorants    = [3][3]float64{{0.4360747, 0.2225045, 0.0139322}, {0.3850649, 0.7168786, 0.0971045}, {0.1430804, 0.0606169, 0.7141733}}
+	adobeColorants   = [3][3]float64{{0.6097, 0.3111, 0.0195}, {0.2053, 0.6257, 0.0609}, {0.1492, 0.0632, 0.7446}}
+	displayColorants = [3][3]float64{{0.5151, 0.2412, -0.0011}, {0.2919, 0.6922, 0.0419}, {0.1571, 0.0666, 0.7841}}
+)
+
+// gammaCurve encodes a "curv" tag with a single gamma.
+func gammaCurve(gamma float64) []byte {
+	tag := append([]byte("curv\x00\x00\x00\x00"), 0, 0, 0, 1)
+	return binary.BigEndian.AppendUint16(tag, uint16(gamma*256+0.5))
+}
+
+// paraCurve encodes a "para" tag of the given function type.
+func paraCurve(funcType uint16, params ...float64) []byte {
+	tag := binary.BigEndian.AppendUint16([]byte("para\x00\x00\x00\x00"), funcType)
+	tag = append(tag, 0, 0)
+	for _, p := range params {
+		tag = binary.BigEndian.AppendUint32(tag, uint32(int32(p*65536+0.5)))
+	}
+	return tag
+}
+
+// srgbPara is the sRGB transfer function as a "para" tag.
+var srgbPara = paraCurve(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+
+// buildProfile encodes an RGB matrix/TRC profile, with a v2 description,
+// the given colorants and the same curve for every channel.
+func buildProfile(space, description string, colorants [3][3]float64, trc []byte) []byte {
+	tags := [][2][]byte{
+		{[]byte("desc"), append(binary.BigEndian.AppendUint32([]byte("desc\x00\x00\x00\x00"), uint32(len(description)+1)), description+"\x00"...)},
+	}
+	for i, name := range []string{"r", "g", "b"} {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for _, v := range colorants[i] {
+			xyz = binary.BigEndian.AppendUint32(xyz, uint32(int32(v*65536+0.5)))
+		}
+		tags = append(tags, [2][]byte{[]byte(name + "XYZ"), xyz}, [2][]byte{[]byte(name + "TRC"), trc})
+	}
+
+	header := make([]byte, 128)
+	copy(header[16:], space)
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := len(header) + 4 + len(tags)*12
+	var body []byte
+	for _, tag := range tags {
+		table = append(table, tag[0]...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(body)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(tag[1])))
+		body = append(body, tag[1]...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	profile := append(append(header, table...), body...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func adobeRGB() []byte {
+	return buildProfile("RGB ", "Adobe RGB (1998)", adobeColorants, gammaCurve(563.0/256))
+}
+
+func TestParse(t *testing.T) {
+	p, err := Parse(adobeRGB())
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if p.Description != "Adobe RGB (1998)" {
+		t.Errorf("Expected the description Adobe RGB (1998), got %q", p.Description)
+	}
+	if p.IsSRGB() {
+		t.Error("Adobe RGB was taken for sRGB")
+	}
+
+	for name, trc := range map[string][]byte{
+		"parametric": srgbPara,
+		"table": func() []byte {
+			tag := binary.BigEndian.AppendUint32([]byte("curv\x00\x00\x00\x00"), 1024)
+			for i := range 1024 {
+				tag = binary.BigEndian.AppendUint16(tag, uint16(srgbCurve.eval(float64(i)/1023)*65535+0.5))
+			}
+			return tag
+		}(),
+	} {
+		p, err := Parse(buildProfile("RGB ", "sRGB", srgbColorants, trc))
+		if err != nil {
+			t.Fatalf("%s: Parse failed: %v", name, err)
+		}
+		if !p.IsSRGB() {
+			t.Errorf("%s: sRGB was not recognised", name)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	noTRC := buildProfile("RGB ", "", adobeColorants, gammaCurve(2.2))
+	copy(noTRC[132+2*12:], "xTRC") // The rTRC entry.
+	for name, tc := range map[string]struct {
+		profile     []byte
+		unsupported bool
+	}{
+		"not a profile":   {[]byte("not a profile"), false},
+		"CMYK":            {buildProfile("CMYK", "", adobeColorants, gammaCurve(2.2)), true},
+		"no curve":        {noTRC, true},
+		"unknown curve":   {buildProfile("RGB ", "", adobeColorants, []byte("sf32\x00\x00\x00\x00\x00\x00\x00\x00")), false},
+		"singular matrix": {buildProfile("RGB ", "", [3][3]float64{{1, 1, 1}, {1, 1, 1}, {0, 0, 1}}, gammaCurve(2.2)), false},
+	} {
+		_, err := Parse(tc.profile)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if errors.Is(err, ErrUnsupported) != tc.unsupported {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestCurves(t *testing.T) {
+	for name, tc := range map[string]struct {
+		tag  []byte
+		x, y float64
+	}{
+		"identity": {[]byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), 0.5, 0.5},
+		"gamma":    {gammaCurve(2), 0.5, 0.25},
+		"type 0":   {paraCurve(0, 2), 0.5, 0.25},
+		"type 1":   {paraCurve(1, 1, 2, -0.5), 0.2, 0},
+		"type 2":   {paraCurve(2, 1, 2, -0.5, 0.25), 0.5, 0.75},
+		"type 3":   {srgbPara, 0.5, 0.214},
+		"type 4":   {paraCurve(4, 1, 1, 0, 0.5, 0.5, 0.1, 0.1), 0.2, 0.2},
+	} {
+		c, err := parseCurve(tc.tag)
+		if err != nil {
+			t.Fatalf("%s: parseCurve failed: %v", name, err)
+		}
+		if y := c.eval(tc.x); y < tc.y-0.001 || y > tc.y+0.001 {
+			t.Errorf("%s: f(%v) = %v, expected %v", name, tc.x, y, tc.y)
+		}
+	}
+}
+
+func TestToSRGB(t *testing.T) {
+	display := buildProfile("RGB ", "Display P3", displayColorants, srgbPara)
+	for name, tc := range map[string]struct {
+		profile []byte
+		in      color.NRGBA
+		want    color.NRGBA
+	}{
+		// The sRGB primaries, expressed in each colour space.
+		"Adobe RGB red":   {adobeRGB(), color.NRGBA{219, 0, 0, 255}, color.NRGBA{255, 0, 0, 255}},
+		"Adobe RGB green": {adobeRGB(), color.NRGBA{144, 255, 60, 128}, color.NRGBA{0, 255, 0, 128}},
+		"Adobe RGB white": {adobeRGB(), color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+		"Display P3 red":  {display, color.NRGBA{234, 51, 35, 255}, color.NRGBA{255, 0, 0, 255}},
+		"Display P3 gray": {display, color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255}},
+		// Outside the sRGB gamut, so clipped.
+		"Adobe RGB pure green": {adobeRGB(), color.NRGBA{0, 255, 0, 255}, color.NRGBA{0, 255, 0, 255}},
+	} {
+		p, err := Parse(tc.profile)
+		if err != nil {
+			t.Fatalf("%s: Parse failed: %v", name, err)
+		}
+		for _, img := range []image.Image{image.NewNRGBA(image.Rect(0, 0, 1, 1)), image.NewNRGBA64(image.Rect(0, 0, 1, 1))} {
+			img.(interface{ Set(x, y int, c color.Color) }).Set(0, 0, tc.in)
+			got := p.ToSRGB(img).NRGBAAt(0, 0)
+			for i, pair := range [][2]uint8{{got.R, tc.want.R}, {got.G, tc.want.G}, {got.B, tc.want.B}, {got.A, tc.want.A}} {
+				if diff := int(pair[0]) - int(pair[1]); diff < -3 || diff > 3 {
+					t.Errorf("%s (%T): channel %d is %d, expected %d", name, img, i, pair[0], pair[1])
+				}
+			}
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	profile := adobeRGB()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+
+	// JPEG, with the profile split into two segments stored out of order.
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	segment := func(seq int, part []byte) []byte {
+		payload := append([]byte(jpegICCMarker), byte(seq), 2)
+		payload = append(payload, part...)
+		return append(binary.BigEndian.AppendUint16([]byte{0xff, 0xe2}, uint16(len(payload)+2)), payload...)
+	}
+	half := len(profile) / 2
+	jpegData := append([]byte{0xff, 0xd8}, segment(2, profile[half:])...)
+	jpegData = append(jpegData, segment(1, profile[:half])...)
+	jpegData = append(jpegData, buf.Bytes()[2:]...)
+
+	// PNG, with an iCCP chunk after IHDR.
+	buf.Reset()
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(profile)
+	zw.Close()
+	iccp := append([]byte("iCCP"), "Adobe RGB\x00\x00"...)
+	iccp = append(iccp, compressed.Bytes()...)
+	pngData := append([]byte(nil), buf.Bytes()[:33]...)
+	pngData = binary.BigEndian.AppendUint32(pngData, uint32(len(iccp)-4))
+	pngData = append(pngData, iccp...)
+	pngData = binary.BigEndian.AppendUint32(pngData, crc32.ChecksumIEEE(iccp))
+	pngData = append(pngData, buf.Bytes()[33:]...)
+
+	// WebP, with the ICCP chunk after VP8X.
+	webpBody := append([]byte("WEBPVP8X"), 10, 0, 0, 0, 0x20, 0, 0, 0, 3, 0, 0, 3, 0, 0)
+	webpBody = append(binary.LittleEndian.AppendUint32(append(webpBody, "ICCP"...), uint32(len(profile))), profile...)
+	webpData := append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(webpBody))), webpBody...)
+
+	// TIFF, with only the ICC profile tag in its IFD.
+	tiffData := []byte("II\x2a\x00\x08\x00\x00\x00\x01\x00")
+	tiffData = binary.LittleEndian.AppendUint16(tiffData, tiffICCTag)
+	tiffData = binary.LittleEndian.AppendUint16(tiffData, 7)
+	tiffData = binary.LittleEndian.AppendUint32(tiffData, uint32(len(profile)))
+	tiffData = binary.LittleEndian.AppendUint32(tiffData, 26)
+	tiffData = append(binary.LittleEndian.AppendUint32(tiffData, 0), profile...)
+
+	for name, data := range map[string][]byte{"JPEG": jpegData, "PNG": pngData, "WebP": webpData, "TIFF": tiffData} {
+		if got := Extract(data); !bytes.Equal(got, profile) {
+			t.Errorf("%s: expected the %d byte profile, got %d bytes", name, len(profile), len(got))
+		}
+	}
+	if _, err := png.Decode(bytes.NewReader(pngData)); err != nil {
+		t.Errorf("The PNG fixture does not decode: %v", err)
+	}
+	if got := Extract(buf.Bytes()); got != nil {
+		t.Errorf("Expected no profile in a plain PNG, got %d bytes", len(got))
+	}
+}
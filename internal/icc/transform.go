@@ -0,0 +1,115 @@
+package icc
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// matrix is a 3x3 matrix, indexed by row and then column.
+type matrix [3][3]float64
+
+// srgbToXYZ maps linear sRGB to D50 XYZ, with the Bradford adaptation from
+// D65 used by the sRGB profiles in common use.
+var srgbToXYZ = matrix{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// xyzToSRGB is the inverse of srgbToXYZ.
+var xyzToSRGB, _ = srgbToXYZ.invert()
+
+// mul returns m×n.
+func (m matrix) mul(n matrix) matrix {
+	var p matrix
+	for i := range 3 {
+		for j := range 3 {
+			for k := range 3 {
+				p[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return p
+}
+
+// invert returns the inverse of m, or false if m is singular.
+func (m matrix) invert() (matrix, bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-9 {
+		return matrix{}, false
+	}
+	var inv matrix
+	for i := range 3 {
+		for j := range 3 {
+			// The cofactor of m[j][i], from the rows and columns after them.
+			r1, r2 := (j+1)%3, (j+2)%3
+			c1, c2 := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[r1][c1]*m[r2][c2] - m[r1][c2]*m[r2][c1]) / det
+		}
+	}
+	return inv, true
+}
+
+// encodeSteps is the number of linear values the sRGB encoding table holds,
+// enough for neighbouring entries to differ by less than one 8-bit step.
+const encodeSteps = 4096
+
+// ToSRGB returns img converted from the colour space p describes to sRGB,
+// with 8 bits per channel. Colours outside the sRGB gamut are clipped, and
+// the alpha channel is kept.
+func (p *Profile) ToSRGB(img image.Image) *image.NRGBA {
+	m := xyzToSRGB.mul(p.toXYZ)
+	var enc [encodeSteps]uint8
+	for i := range enc {
+		v := float64(i) / (encodeSteps - 1)
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		enc[i] = uint8(math.Round(v * 255))
+	}
+	convert := func(dst []uint8, lin *[3][]float32, r, g, b int) {
+		rgb := [3]float32{lin[0][r], lin[1][g], lin[2][b]}
+		for i := range 3 {
+			v := float32(m[i][0])*rgb[0] + float32(m[i][1])*rgb[1] + float32(m[i][2])*rgb[2]
+			dst[i] = enc[int(min(max(v, 0), 1)*(encodeSteps-1)+0.5)]
+		}
+	}
+
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(bounds)
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		// Keep the precision of 16-bit images until they are converted.
+		lin := p.tables(1 << 16)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				i := dst.PixOffset(x, y)
+				convert(dst.Pix[i:i+3], &lin, int(c.R), int(c.G), int(c.B))
+				dst.Pix[i+3] = uint8(c.A >> 8)
+			}
+		}
+	default:
+		draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+		lin := p.tables(1 << 8)
+		for i := 0; i < len(dst.Pix); i += 4 {
+			convert(dst.Pix[i:i+3], &lin, int(dst.Pix[i]), int(dst.Pix[i+1]), int(dst.Pix[i+2]))
+		}
+	}
+	return dst
+}
+
+// tables samples the tone reproduction curves of p at n encoded values.
+func (p *Profile) tables(n int) [3][]float32 {
+	var lin [3][]float32
+	for i, c := range p.curves {
+		lin[i] = c.sample(n)
+	}
+	return lin
+}
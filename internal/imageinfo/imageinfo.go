@@ -0,0 +1,144 @@
+// Package imageinfo describes image files the way the converter sees them:
+// the sniffed MIME type, dimensions, colour model, transparency, frame
+// count and, for WebP files, the layout of the RIFF container.
+package imageinfo
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"os"
+
+	_ "image/jpeg" // Register JPEG decoder
+	_ "image/png"  // Register PNG decoder
+
+	_ "golang.org/x/image/bmp"  // Register BMP decoder
+	_ "golang.org/x/image/tiff" // Register TIFF decoder
+	_ "golang.org/x/image/webp" // Register WebP decoder
+
+	"imageconverter/internal/converter"
+)
+
+// Info describes an image file.
+type Info struct {
+	Path     string `json:"path"`
+	MIMEType string `json:"mime_type"`
+	// Format is the name of the decoder that reads the file, empty if the
+	// file is not a supported image.
+	Format     string `json:"format,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	ColorModel string `json:"color_model,omitempty"`
+	// Alpha reports whether any pixel is not fully opaque. For animated
+	// WebP files, which are not decoded, it is the VP8X alpha flag.
+	Alpha  bool `json:"alpha"`
+	Frames int  `json:"frames,omitempty"`
+	// Chunks is the RIFF chunk layout of WebP files.
+	Chunks []Chunk `json:"chunks,omitempty"`
+	// Error describes why the image could not be decoded, if it could not.
+	Error string `json:"error,omitempty"`
+}
+
+// DetectContentType sniffs the MIME type of a file header. It extends
+// http.DetectContentType, which has no signature for TIFF.
+func DetectContentType(header []byte) string {
+	if converter.IsTIFF(header) {
+		return "image/tiff"
+	}
+	return http.DetectContentType(header)
+}
+
+// Inspect reads the file at path and describes it. Files that are not
+// images, or cannot be decoded, are described as far as possible with
+// Info.Error set; the error is only returned if the file cannot be read.
+func Inspect(path string) (Info, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Path: path, MIMEType: DetectContentType(data[:min(len(data), 512)])}
+
+	if info.MIMEType == "image/webp" {
+		webp, err := parseWebP(data)
+		info.Chunks = webp.chunks
+		if err != nil {
+			info.Error = err.Error()
+			return info, nil
+		}
+		if webp.animated {
+			// Animated WebP cannot be decoded; describe it from the container.
+			info.Format = "webp"
+			info.Width, info.Height = webp.width, webp.height
+			info.Alpha = webp.alpha
+			info.Frames = webp.frames
+			return info, nil
+		}
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		info.Error = err.Error()
+		return info, nil
+	}
+	info.Format = format
+	info.Width, info.Height = config.Width, config.Height
+	info.ColorModel = colorModelName(config.ColorModel)
+	info.Frames = 1
+
+	switch format {
+	case "gif":
+		if all, err := gif.DecodeAll(bytes.NewReader(data)); err == nil {
+			info.Frames = len(all.Image)
+		}
+	case "tiff":
+		if pages, err := converter.TIFFPageCount(path); err == nil {
+			info.Frames = pages
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		info.Error = err.Error()
+		return info, nil
+	}
+	info.Alpha = !converter.Opaque(img)
+	return info, nil
+}
+
+// colorModelName names the standard library's colour models.
+func colorModelName(model color.Model) string {
+	switch model {
+	case color.RGBAModel:
+		return "RGBA"
+	case color.RGBA64Model:
+		return "RGBA64"
+	case color.NRGBAModel:
+		return "NRGBA"
+	case color.NRGBA64Model:
+		return "NRGBA64"
+	case color.AlphaModel:
+		return "Alpha"
+	case color.Alpha16Model:
+		return "Alpha16"
+	case color.GrayModel:
+		return "Gray"
+	case color.Gray16Model:
+		return "Gray16"
+	case color.CMYKModel:
+		return "CMYK"
+	case color.YCbCrModel:
+		return "YCbCr"
+	case color.NYCbCrAModel:
+		return "NYCbCrA"
+	}
+	if palette, ok := model.(color.Palette); ok {
+		if len(palette) == 0 {
+			return "Paletted" // E.g. a GIF with only per-frame colour tables.
+		}
+		return fmt.Sprintf("Paletted (%d colours)", len(palette))
+	}
+	return fmt.Sprintf("%T", model)
+}
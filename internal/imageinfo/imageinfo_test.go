@@ -0,0 +1,176 @@
+package imageinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"imageconverter/internal/vp8l"
+)
+
+// writeFile writes data to a file in a temporary directory and returns its path.
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+// chunk encodes a RIFF chunk, padded to an even size.
+func chunk(id string, payload []byte) []byte {
+	out := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	out = append(out, payload...)
+	if len(payload)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// riff wraps chunks in a RIFF WEBP container.
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// vp8x encodes a VP8X payload for a width x height canvas.
+func vp8x(flags byte, width, height int) []byte {
+	w, h := width-1, height-1
+	return []byte{flags, 0, 0, 0, byte(w), byte(w >> 8), byte(w >> 16), byte(h), byte(h >> 8), byte(h >> 16)}
+}
+
+// losslessBitstream returns the VP8L chunk payload of a lossless WebP of img.
+func losslessBitstream(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := vp8l.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode WebP: %v", err)
+	}
+	chunks, err := parseChunks(buf.Bytes(), 12)
+	if err != nil || len(chunks) != 1 || chunks[0].ID != "VP8L" {
+		t.Fatalf("Unexpected vp8l output %v: %v", chunks, err)
+	}
+	return buf.Bytes()[20 : 20+chunks[0].Size]
+}
+
+func TestInspect_PNGWithAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 5, 3))
+	img.Set(1, 1, color.NRGBA{R: 255, A: 128})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	info, err := Inspect(writeFile(t, "alpha.png", buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.MIMEType != "image/png" || info.Format != "png" || info.Width != 5 || info.Height != 3 ||
+		info.ColorModel != "NRGBA" || !info.Alpha || info.Frames != 1 || info.Error != "" {
+		t.Errorf("Unexpected info %+v", info)
+	}
+}
+
+func TestInspect_AnimatedGIF(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("Failed to encode GIF: %v", err)
+	}
+
+	info, err := Inspect(writeFile(t, "anim.gif", buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.Frames != 3 || info.ColorModel != "Paletted" || info.Alpha {
+		t.Errorf("Unexpected info %+v", info)
+	}
+}
+
+func TestInspect_WebPChunks(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 6, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	bitstream := losslessBitstream(t, img)
+	exif := []byte("Exif\x00\x00MM")
+	data := riff(
+		chunk("VP8X", vp8x(vp8xEXIF, 6, 4)),
+		chunk("VP8L", bitstream),
+		chunk("EXIF", exif),
+	)
+
+	info, err := Inspect(writeFile(t, "image.webp", data))
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.MIMEType != "image/webp" || info.Width != 6 || info.Height != 4 || info.Alpha || info.Error != "" {
+		t.Errorf("Unexpected info %+v", info)
+	}
+	want := []Chunk{
+		{ID: "VP8X", Offset: 12, Size: 10, Details: "canvas 6x4, flags: EXIF"},
+		{ID: "VP8L", Offset: 30, Size: uint32(len(bitstream)), Details: "lossless, 6x4"},
+		{ID: "EXIF", Offset: 38 + int64(len(bitstream)+len(bitstream)%2), Size: uint32(len(exif))},
+	}
+	if !reflect.DeepEqual(info.Chunks, want) {
+		t.Errorf("Chunks are\n%+v\nexpected\n%+v", info.Chunks, want)
+	}
+}
+
+func TestInspect_AnimatedWebP(t *testing.T) {
+	frame := losslessBitstream(t, image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	anmf := func(x int) []byte {
+		header := []byte{byte(x / 2), 0, 0, 0, 0, 0, 1, 0, 0, 1, 0, 0, 100, 0, 0, 0}
+		return chunk("ANMF", append(header, chunk("VP8L", frame)...))
+	}
+	data := riff(
+		chunk("VP8X", vp8x(vp8xAnimation|vp8xAlpha, 4, 2)),
+		chunk("ANIM", []byte{0, 0, 0, 0, 0, 0}),
+		anmf(0),
+		anmf(2),
+	)
+
+	info, err := Inspect(writeFile(t, "anim.webp", data))
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.Format != "webp" || info.Width != 4 || info.Height != 2 || !info.Alpha || info.Frames != 2 || info.Error != "" {
+		t.Errorf("Unexpected info %+v", info)
+	}
+	if len(info.Chunks) != 4 || info.Chunks[1].Details != "loops forever" || info.Chunks[3].Details != "frame 2x2 at (2,0), 100 ms" {
+		t.Fatalf("Unexpected chunks %+v", info.Chunks)
+	}
+	if nested := info.Chunks[3].Chunks; len(nested) != 1 || nested[0].ID != "VP8L" || nested[0].Offset != info.Chunks[3].Offset+24 {
+		t.Errorf("Unexpected frame chunks %+v", nested)
+	}
+}
+
+func TestInspect_TruncatedWebP(t *testing.T) {
+	data := riff(chunk("VP8X", vp8x(0, 1, 1)), chunk("VP8L", []byte{0x2f, 0, 0, 0, 0, 0}))
+	info, err := Inspect(writeFile(t, "truncated.webp", data[:len(data)-4]))
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.Error == "" {
+		t.Errorf("No error reported for a truncated file: %+v", info)
+	}
+
+	info, err = Inspect(writeFile(t, "notes.txt", []byte("hello")))
+	if err != nil || info.MIMEType != "text/plain; charset=utf-8" || info.Format != "" || info.Error == "" {
+		t.Errorf("Unexpected info %+v, %v for a text file", info, err)
+	}
+}
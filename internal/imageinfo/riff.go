@@ -0,0 +1,169 @@
+package imageinfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Chunk is a chunk of a WebP RIFF container.
+type Chunk struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"` // Offset of the chunk header in the file.
+	Size   uint32 `json:"size"`   // Payload size, excluding the header and padding.
+	// Details summarises the payload of chunks whose headers are decoded.
+	Details string `json:"details,omitempty"`
+	// Chunks are the frame's chunks for ANMF chunks.
+	Chunks []Chunk `json:"chunks,omitempty"`
+}
+
+// VP8X feature flags.
+const (
+	vp8xAnimation = 1 << 1
+	vp8xXMP       = 1 << 2
+	vp8xEXIF      = 1 << 3
+	vp8xAlpha     = 1 << 4
+	vp8xICC       = 1 << 5
+)
+
+// webpLayout is what parseWebP learns from a WebP container.
+type webpLayout struct {
+	chunks        []Chunk
+	animated      bool
+	alpha         bool // The VP8X alpha flag.
+	width, height int  // The VP8X canvas size.
+	frames        int  // The number of ANMF chunks.
+}
+
+// parseWebP walks the chunks of the WebP file in data. On error it returns
+// the chunks read so far.
+func parseWebP(data []byte) (webpLayout, error) {
+	var layout webpLayout
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return layout, errors.New("not a RIFF WEBP file")
+	}
+	riffSize := int64(binary.LittleEndian.Uint32(data[4:8]))
+	if 8+riffSize > int64(len(data)) {
+		return layout, fmt.Errorf("RIFF size %d exceeds the file size %d", riffSize, len(data)-8)
+	}
+
+	chunks, err := parseChunks(data[:8+riffSize], 12)
+	layout.chunks = chunks
+	for _, c := range chunks {
+		switch c.ID {
+		case "VP8X":
+			if c.Size < 10 {
+				continue
+			}
+			payload := data[c.Offset+8 : c.Offset+8+int64(c.Size)]
+			layout.animated = payload[0]&vp8xAnimation != 0
+			layout.alpha = payload[0]&vp8xAlpha != 0
+			layout.width = int(uint24(payload[4:7])) + 1
+			layout.height = int(uint24(payload[7:10])) + 1
+		case "ANMF":
+			layout.frames++
+		}
+	}
+	return layout, err
+}
+
+// parseChunks reads the chunks in data from offset to the end.
+func parseChunks(data []byte, offset int64) ([]Chunk, error) {
+	var chunks []Chunk
+	for offset < int64(len(data)) {
+		if offset+8 > int64(len(data)) {
+			return chunks, fmt.Errorf("truncated chunk header at offset %d", offset)
+		}
+		c := Chunk{
+			ID:     string(data[offset : offset+4]),
+			Offset: offset,
+			Size:   binary.LittleEndian.Uint32(data[offset+4 : offset+8]),
+		}
+		end := offset + 8 + int64(c.Size)
+		if end > int64(len(data)) {
+			chunks = append(chunks, c)
+			return chunks, fmt.Errorf("chunk %q at offset %d overruns the container by %d bytes", c.ID, offset, end-int64(len(data)))
+		}
+		payload := data[offset+8 : end]
+		var err error
+		c.Details, err = describeChunk(c.ID, payload)
+		if err == nil && c.ID == "ANMF" && len(payload) >= 16 {
+			// The frame's own chunks follow the 16-byte frame header. Their
+			// offsets are relative to the file like every other chunk's.
+			c.Chunks, err = parseChunks(data[:end], offset+8+16)
+		}
+		chunks = append(chunks, c)
+		if err != nil {
+			return chunks, fmt.Errorf("chunk %q at offset %d: %w", c.ID, offset, err)
+		}
+		offset = end + int64(c.Size%2) // Payloads are padded to an even size.
+	}
+	return chunks, nil
+}
+
+// describeChunk summarises the payload of the chunk types that carry image
+// properties.
+func describeChunk(id string, payload []byte) (string, error) {
+	switch id {
+	case "VP8X":
+		if len(payload) < 10 {
+			return "", errors.New("too short")
+		}
+		var flags []string
+		for _, f := range []struct {
+			bit  byte
+			name string
+		}{{vp8xICC, "ICC"}, {vp8xAlpha, "alpha"}, {vp8xEXIF, "EXIF"}, {vp8xXMP, "XMP"}, {vp8xAnimation, "animation"}} {
+			if payload[0]&f.bit != 0 {
+				flags = append(flags, f.name)
+			}
+		}
+		details := fmt.Sprintf("canvas %dx%d", uint24(payload[4:7])+1, uint24(payload[7:10])+1)
+		if len(flags) > 0 {
+			details += ", flags: " + strings.Join(flags, ", ")
+		}
+		return details, nil
+	case "VP8 ":
+		// A 3-byte frame tag, the start code 9d 01 2a, then 14-bit dimensions.
+		if len(payload) < 10 || payload[3] != 0x9d || payload[4] != 0x01 || payload[5] != 0x2a {
+			return "", errors.New("invalid VP8 frame header")
+		}
+		width := binary.LittleEndian.Uint16(payload[6:8]) & 0x3fff
+		height := binary.LittleEndian.Uint16(payload[8:10]) & 0x3fff
+		return fmt.Sprintf("lossy, %dx%d", width, height), nil
+	case "VP8L":
+		// The signature 0x2f, then 14-bit width-1 and height-1 and an alpha hint.
+		if len(payload) < 5 || payload[0] != 0x2f {
+			return "", errors.New("invalid VP8L header")
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:5])
+		details := fmt.Sprintf("lossless, %dx%d", bits&0x3fff+1, bits>>14&0x3fff+1)
+		if bits>>28&1 != 0 {
+			details += ", alpha"
+		}
+		return details, nil
+	case "ANIM":
+		if len(payload) < 6 {
+			return "", errors.New("too short")
+		}
+		loops := binary.LittleEndian.Uint16(payload[4:6])
+		if loops == 0 {
+			return "loops forever", nil
+		}
+		return fmt.Sprintf("loops %d times", loops), nil
+	case "ANMF":
+		if len(payload) < 16 {
+			return "", errors.New("too short")
+		}
+		return fmt.Sprintf("frame %dx%d at (%d,%d), %d ms",
+			uint24(payload[6:9])+1, uint24(payload[9:12])+1,
+			2*uint24(payload[0:3]), 2*uint24(payload[3:6]), uint24(payload[12:15])), nil
+	}
+	return "", nil
+}
+
+// uint24 decodes a little-endian 24-bit integer.
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
@@ -0,0 +1,244 @@
+// Package proxy serves a directory of images over HTTP, converting JPEG and
+// PNG files to WebP for clients that accept it.
+//
+// Converted images are cached on disk under a key derived from the source
+// path, its modification time and size, and the conversion options, so an
+// image is converted once and converted again only after it changes. Cache
+// file names start with a hash of the source path, and writing a new entry
+// removes the other entries for the same path, so the cache holds at most
+// one version of each image. Entries for deleted sources are kept.
+// Responses for JPEG and PNG files carry "Vary: Accept", since their
+// content depends on the request's Accept header.
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "image/jpeg" // Register JPEG decoder
+	_ "image/png"  // Register PNG decoder
+
+	"imageconverter/internal/converter"
+	"imageconverter/internal/imageinfo"
+)
+
+// Config controls a Proxy.
+type Config struct {
+	// Root is the directory served.
+	Root string
+	// CacheDir is the directory converted images are stored in. It is
+	// created if it does not exist.
+	CacheDir string
+	// Options, if set, returns the conversion options for the source file
+	// at path. The output format is always WebP.
+	Options func(path string) converter.Options
+	// OnError, if set, is called when a conversion fails. The original
+	// image is served instead.
+	OnError func(path string, err error)
+}
+
+// Proxy is an http.Handler serving the files under Config.Root.
+type Proxy struct {
+	cfg Config
+
+	mu         sync.Mutex
+	converting map[string]chan struct{} // Closed when the conversion for a cache key ends.
+}
+
+// New returns a Proxy for the given configuration.
+func New(cfg Config) (*Proxy, error) {
+	info, err := os.Stat(cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", cfg.Root)
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %w", cfg.CacheDir, err)
+	}
+	return &Proxy{cfg: cfg, converting: make(map[string]chan struct{})}, nil
+}
+
+// ServeHTTP implements http.Handler. Only regular files are served;
+// directories and hidden files (any path segment starting with ".") are
+// not found.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "only GET and HEAD are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	urlPath := path.Clean("/" + r.URL.Path)
+	for _, segment := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(segment, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	fPath := filepath.Join(p.cfg.Root, filepath.FromSlash(urlPath))
+
+	file, err := os.Open(fPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(file, header)
+	mimeType := imageinfo.DetectContentType(header[:n])
+	if mimeType != "image/jpeg" && mimeType != "image/png" {
+		http.ServeContent(w, r, fPath, info.ModTime(), file)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if acceptsWebP(r.Header.Get("Accept")) {
+		cached, err := p.cached(fPath, info)
+		if err == nil {
+			defer cached.Close()
+			w.Header().Set("Content-Type", "image/webp")
+			http.ServeContent(w, r, fPath, info.ModTime(), cached)
+			return
+		}
+		if p.cfg.OnError != nil {
+			p.cfg.OnError(fPath, err)
+		}
+	}
+	w.Header().Set("Content-Type", mimeType)
+	http.ServeContent(w, r, fPath, info.ModTime(), file)
+}
+
+// cached opens the cached WebP of the file at fPath, converting it first if
+// it is not cached yet. Concurrent requests for the same image wait for a
+// single conversion.
+func (p *Proxy) cached(fPath string, info os.FileInfo) (*os.File, error) {
+	opts := converter.Options{}
+	if p.cfg.Options != nil {
+		opts = p.cfg.Options(fPath)
+	}
+	opts.Format = converter.FormatWebP
+	opts.OnlyIfSmaller = false
+	cachePath := filepath.Join(p.cfg.CacheDir, cacheKey(fPath, info, opts)+".webp")
+
+	var done chan struct{}
+	for done == nil {
+		if cached, err := os.Open(cachePath); err == nil {
+			return cached, nil
+		}
+		p.mu.Lock()
+		if wait, busy := p.converting[cachePath]; busy {
+			p.mu.Unlock()
+			// If the other conversion fails, this request tries again and
+			// reports its own error.
+			<-wait
+			continue
+		}
+		done = make(chan struct{})
+		p.converting[cachePath] = done
+		p.mu.Unlock()
+	}
+	defer func() {
+		p.mu.Lock()
+		delete(p.converting, cachePath)
+		close(done)
+		p.mu.Unlock()
+	}()
+
+	data, err := os.ReadFile(fPath)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := converter.ConvertBytes(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCache(cachePath, out); err != nil {
+		return nil, err
+	}
+	removeStale(cachePath)
+	return os.Open(cachePath)
+}
+
+// cacheKey identifies the conversion of a version of the file at fPath with
+// opts. It is a hash of the path, then a dash and a hash of the version and
+// options, so that all entries for a path share a prefix.
+func cacheKey(fPath string, info os.FileInfo, opts converter.Options) string {
+	abs, err := filepath.Abs(fPath)
+	if err != nil {
+		abs = fPath
+	}
+	pathHash := sha256.Sum256([]byte(abs))
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%d\x00%+v", info.ModTime().UnixNano(), info.Size(), opts)
+	return hex.EncodeToString(pathHash[:]) + "-" + hex.EncodeToString(h.Sum(nil))
+}
+
+// removeStale removes the cache entries for the same source path as
+// cachePath other than cachePath itself: older versions of the image, or
+// conversions with options no longer in use. Errors are ignored; a stale
+// entry that cannot be removed is only wasted space.
+func removeStale(cachePath string) {
+	dir, name := filepath.Split(cachePath)
+	prefix, _, _ := strings.Cut(name, "-")
+	matches, _ := filepath.Glob(filepath.Join(dir, prefix+"-*.webp"))
+	for _, match := range matches {
+		if match != cachePath {
+			os.Remove(match)
+		}
+	}
+}
+
+// writeCache stores data at path through a temporary file, so that
+// concurrent readers never see a partial image.
+func writeCache(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".cache*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// acceptsWebP reports whether an Accept header lists image/webp with a
+// non-zero quality. Wildcards are not enough: clients that only send */*
+// get the original format.
+func acceptsWebP(accept string) bool {
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil || mediaType != "image/webp" {
+			continue
+		}
+		q, err := strconv.ParseFloat(params["q"], 64)
+		return params["q"] == "" || err == nil && q > 0
+	}
+	return false
+}
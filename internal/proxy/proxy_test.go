@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	xwebp "golang.org/x/image/webp"
+
+	"imageconverter/internal/converter"
+)
+
+// writePNG writes a small PNG image to path.
+func writePNG(t *testing.T, path string) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	img.Set(0, 0, color.NRGBA{A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// get requests urlPath from p with the given Accept header.
+func get(p *Proxy, urlPath, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, urlPath, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec
+}
+
+// cacheEntries returns the number of files in dir.
+func cacheEntries(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read cache directory: %v", err)
+	}
+	return len(entries)
+}
+
+func TestProxy_ContentNegotiation(t *testing.T) {
+	root, cacheDir := t.TempDir(), filepath.Join(t.TempDir(), "cache")
+	if err := os.MkdirAll(filepath.Join(root, "img"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writePNG(t, filepath.Join(root, "img", "photo.png"))
+	var requested []string
+	p, err := New(Config{
+		Root:     root,
+		CacheDir: cacheDir,
+		Options: func(path string) converter.Options {
+			requested = append(requested, path)
+			return converter.Options{MaxWidth: 8}
+		},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	rec := get(p, "/img/photo.png", "image/avif,image/webp,*/*;q=0.8")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("Got %d with Content-Type %q, expected a WebP", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec.Header().Get("Vary") != "Accept" {
+		t.Errorf("Vary is %q, expected Accept", rec.Header().Get("Vary"))
+	}
+	img, err := xwebp.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("Response is not a WebP image: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 8 || b.Dy() != 4 {
+		t.Errorf("Output is %dx%d, expected the configured 8x4", b.Dx(), b.Dy())
+	}
+	if len(requested) != 1 || requested[0] != filepath.Join(root, "img", "photo.png") {
+		t.Errorf("Options requested for %v", requested)
+	}
+
+	// A second request is served from the cache.
+	if rec := get(p, "/img/photo.png", "image/webp"); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("Cached request got %d with Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if n := cacheEntries(t, cacheDir); n != 1 {
+		t.Errorf("Cache holds %d entries, expected 1", n)
+	}
+
+	// Clients without image/webp in Accept get the original.
+	for _, accept := range []string{"", "*/*", "image/*", "image/webp;q=0"} {
+		rec := get(p, "/img/photo.png", accept)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: got %d with Content-Type %q and Vary %q, expected the original PNG", accept, rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("Vary"))
+		}
+	}
+
+	// Modifying the source invalidates the cached image, and the new entry
+	// replaces the old one.
+	writePNG(t, filepath.Join(root, "img", "photo.png"))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(root, "img", "photo.png"), later, later)
+	before, _ := os.ReadDir(cacheDir)
+	if rec := get(p, "/img/photo.png", "image/webp"); rec.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("Request after the source changed got Content-Type %q", rec.Header().Get("Content-Type"))
+	}
+	after, _ := os.ReadDir(cacheDir)
+	if len(after) != 1 || len(before) != 1 || after[0].Name() == before[0].Name() {
+		t.Errorf("Cache holds %v after the source changed, expected one entry replacing %v", after, before)
+	}
+
+	// Entries for other images are kept.
+	writePNG(t, filepath.Join(root, "img", "other.png"))
+	get(p, "/img/other.png", "image/webp")
+	if n := cacheEntries(t, cacheDir); n != 2 {
+		t.Errorf("Cache holds %d entries for two images, expected 2", n)
+	}
+}
+
+func TestProxy_OtherFiles(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(root, ".secret"), []byte("hidden"), 0644)
+	os.WriteFile(filepath.Join(root, "broken.png"), []byte("\x89PNG\r\n\x1a\nbroken"), 0644)
+	var failed []string
+	p, err := New(Config{Root: root, CacheDir: t.TempDir(), OnError: func(path string, err error) { failed = append(failed, path) }})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	rec := get(p, "/notes.txt", "image/webp")
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" || rec.Header().Get("Vary") != "" {
+		t.Errorf("notes.txt: got %d %q with Vary %q, expected the file unchanged", rec.Code, rec.Body, rec.Header().Get("Vary"))
+	}
+	for _, urlPath := range []string{"/.secret", "/missing.png", "/", "/../" + filepath.Base(root) + "/notes.txt/.."} {
+		if rec := get(p, urlPath, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, expected 404", urlPath, rec.Code)
+		}
+	}
+
+	// Images that cannot be converted are served as they are.
+	rec = get(p, "/broken.png", "image/webp")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || len(failed) != 1 {
+		t.Errorf("broken.png: got %d with Content-Type %q and errors for %v", rec.Code, rec.Header().Get("Content-Type"), failed)
+	}
+}
+
+func TestAcceptsWebP(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"image/webp":                         true,
+		"image/avif,image/webp,*/*;q=0.8":    true,
+		"text/html, image/webp;q=0.5":        true,
+		"image/webp;q=0":                     false,
+		"*/*":                                false,
+		"image/png,image/*;q=0.8":            false,
+		"":                                   false,
+		"image/webpx, application/xhtml+xml": false,
+	} {
+		if got := acceptsWebP(accept); got != want {
+			t.Errorf("acceptsWebP(%q) = %v, expected %v", accept, got, want)
+		}
+	}
+}
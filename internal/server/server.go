@@ -0,0 +1,278 @@
+// Package server exposes the converter over HTTP.
+//
+// POST /convert takes an image as the raw request body or as the "file"
+// field of a multipart form and responds with the converted image.
+// Conversion options are passed as query parameters using the keys of
+// configuration files (see package config), plus "to" for the output
+// format:
+//
+//	curl --data-binary @photo.jpg 'localhost:8080/convert?quality=70&max-width=1024' > photo.webp
+//
+// GET /healthz reports that the server is up and GET /metrics exposes
+// request counters in the Prometheus text format.
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "image/gif"  // Register GIF decoder
+	_ "image/jpeg" // Register JPEG decoder
+	_ "image/png"  // Register PNG decoder
+
+	_ "golang.org/x/image/bmp"  // Register BMP decoder
+	_ "golang.org/x/image/tiff" // Register TIFF decoder
+	_ "golang.org/x/image/webp" // Register WebP decoder
+
+	"imageconverter/internal/config"
+	"imageconverter/internal/converter"
+)
+
+// Defaults used when the corresponding Config fields are zero.
+const (
+	DefaultMaxBodySize   = 32 << 20
+	DefaultMaxConcurrent = 4
+	DefaultMaxPixels     = 50_000_000
+)
+
+// Config controls a Server.
+type Config struct {
+	// MaxBodySize is the largest request body accepted, in bytes.
+	MaxBodySize int64
+	// MaxConcurrent is how many conversions may run at once. Requests
+	// beyond that are rejected with 503 Service Unavailable.
+	MaxConcurrent int
+	// MaxPixels is the largest image accepted, in pixels. Larger images
+	// are rejected with 413 Request Entity Too Large before they are
+	// decoded, since a small file can declare huge dimensions.
+	MaxPixels int64
+	// Options are the conversion options that query parameters override.
+	Options converter.Options
+}
+
+// Server is an http.Handler serving the conversion endpoints.
+type Server struct {
+	cfg   Config
+	mux   *http.ServeMux
+	slots chan struct{} // Holds one token per running conversion.
+
+	mu          sync.Mutex
+	requests    map[int]uint64 // Completed /convert requests by status code.
+	inputBytes  uint64
+	outputBytes uint64
+	seconds     float64 // Total time spent converting.
+}
+
+// New returns a Server with the given configuration.
+func New(cfg Config) *Server {
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = DefaultMaxBodySize
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = DefaultMaxConcurrent
+	}
+	if cfg.MaxPixels <= 0 {
+		cfg.MaxPixels = DefaultMaxPixels
+	}
+	s := &Server{
+		cfg:      cfg,
+		mux:      http.NewServeMux(),
+		slots:    make(chan struct{}, cfg.MaxConcurrent),
+		requests: make(map[int]uint64),
+	}
+	s.mux.HandleFunc("/convert", s.handleConvert)
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleConvert converts the uploaded image.
+func (s *Server) handleConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.fail(w, http.StatusMethodNotAllowed, "only POST is supported")
+		return
+	}
+	opts, err := s.options(r)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Take a slot before reading the body, so that MaxConcurrent also
+	// bounds the memory held by uploads.
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		s.fail(w, http.StatusServiceUnavailable, "too many conversions in progress")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize)
+	data, err := readImage(r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.fail(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", s.cfg.MaxBodySize))
+			return
+		}
+		s.fail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		s.fail(w, http.StatusUnprocessableEntity, fmt.Sprintf("failed to read image header: %v", err))
+		return
+	}
+	if pixels := int64(imgCfg.Width) * int64(imgCfg.Height); pixels > s.cfg.MaxPixels {
+		s.fail(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("image is %dx%d, more than %d pixels", imgCfg.Width, imgCfg.Height, s.cfg.MaxPixels))
+		return
+	}
+
+	start := time.Now()
+	out, res, err := converter.ConvertBytes(data, opts)
+	if err != nil {
+		s.fail(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	enc, _ := converter.EncoderFor(opts.Format) // Validated by ConvertBytes.
+
+	s.mu.Lock()
+	s.requests[http.StatusOK]++
+	s.inputBytes += uint64(len(data))
+	s.outputBytes += uint64(len(out))
+	s.seconds += time.Since(start).Seconds()
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", enc.MIMEType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Header().Set("X-Image-Width", strconv.Itoa(res.Width))
+	w.Header().Set("X-Image-Height", strconv.Itoa(res.Height))
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// options returns the conversion options for r: the server's options with
+// the query parameters applied.
+func (s *Server) options(r *http.Request) (converter.Options, error) {
+	opts := s.cfg.Options
+	var settings config.Settings
+	query := r.URL.Query()
+	for key, values := range query {
+		value := values[len(values)-1]
+		if key == "to" {
+			opts.Format = value
+			continue
+		}
+		if value == "" {
+			value = "true" // A bare key such as ?lossless.
+		}
+		if err := settings.Set(key, value); err != nil {
+			return converter.Options{}, err
+		}
+	}
+	if err := settings.Validate(); err != nil {
+		return converter.Options{}, err
+	}
+	settings.Apply(&opts)
+	if _, err := converter.EncoderFor(opts.Format); err != nil {
+		return converter.Options{}, err
+	}
+	if err := opts.Validate(); err != nil {
+		return converter.Options{}, err
+	}
+	return opts, nil
+}
+
+// readImage returns the image uploaded with r: the "file" field of a
+// multipart form, or else the raw request body.
+func readImage(r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return nil, errors.New("request body is empty")
+		}
+		return data, nil
+	}
+
+	parts, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil, errors.New(`multipart form has no "file" field`)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return io.ReadAll(part)
+		}
+	}
+}
+
+// fail writes a plain-text error response and counts it.
+func (s *Server) fail(w http.ResponseWriter, code int, msg string) {
+	s.mu.Lock()
+	s.requests[code]++
+	s.mu.Unlock()
+	http.Error(w, msg, code)
+}
+
+// handleHealthz reports that the server is running.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleMetrics writes the counters in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	codes := make([]int, 0, len(s.requests))
+	for code := range s.requests {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP imageconverter_requests_total Completed /convert requests by status code.")
+	fmt.Fprintln(w, "# TYPE imageconverter_requests_total counter")
+	for _, code := range codes {
+		fmt.Fprintf(w, "imageconverter_requests_total{code=\"%d\"} %d\n", code, s.requests[code])
+	}
+	fmt.Fprintln(w, "# HELP imageconverter_conversions_in_flight Conversions currently running.")
+	fmt.Fprintln(w, "# TYPE imageconverter_conversions_in_flight gauge")
+	fmt.Fprintf(w, "imageconverter_conversions_in_flight %d\n", len(s.slots))
+	fmt.Fprintln(w, "# HELP imageconverter_input_bytes_total Bytes of images converted successfully.")
+	fmt.Fprintln(w, "# TYPE imageconverter_input_bytes_total counter")
+	fmt.Fprintf(w, "imageconverter_input_bytes_total %d\n", s.inputBytes)
+	fmt.Fprintln(w, "# HELP imageconverter_output_bytes_total Bytes of converted images returned.")
+	fmt.Fprintln(w, "# TYPE imageconverter_output_bytes_total counter")
+	fmt.Fprintf(w, "imageconverter_output_bytes_total %d\n", s.outputBytes)
+	fmt.Fprintln(w, "# HELP imageconverter_conversion_seconds_total Time spent converting images.")
+	fmt.Fprintln(w, "# TYPE imageconverter_conversion_seconds_total counter")
+	fmt.Fprintf(w, "imageconverter_conversion_seconds_total %g\n", s.seconds)
+	s.mu.Unlock()
+}
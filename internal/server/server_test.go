@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// testPNG returns a small PNG image.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 8), G: uint8(y * 8), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvert(t *testing.T) {
+	srv := httptest.NewServer(New(Config{}))
+	defer srv.Close()
+	input := testPNG(t, 32, 16)
+
+	t.Run("raw body", func(t *testing.T) {
+		resp, err := http.Post(srv.URL+"/convert?max-width=16", "image/png", bytes.NewReader(input))
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Status %d, expected 200: %s", resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "image/webp" {
+			t.Errorf("Content-Type %q, expected image/webp", got)
+		}
+		img, err := xwebp.Decode(resp.Body)
+		if err != nil {
+			t.Fatalf("Response is not a WebP image: %v", err)
+		}
+		if b := img.Bounds(); b.Dx() != 16 || b.Dy() != 8 {
+			t.Errorf("Output is %dx%d, expected 16x8", b.Dx(), b.Dy())
+		}
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("comment", "ignored")
+		part, _ := form.CreateFormFile("file", "image.png")
+		part.Write(input)
+		form.Close()
+		resp, err := http.Post(srv.URL+"/convert?to=jpeg&quality=50", form.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+			t.Errorf("Got status %d and Content-Type %q, expected 200 and image/jpeg", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	})
+}
+
+// hugePNG returns a small PNG whose header declares 30000x30000 pixels.
+func hugePNG(t *testing.T) []byte {
+	t.Helper()
+	data := testPNG(t, 4, 4)
+	ihdr := data[12:29] // Chunk type and data, covered by the CRC.
+	binary.BigEndian.PutUint32(ihdr[4:], 30000)
+	binary.BigEndian.PutUint32(ihdr[8:], 30000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(ihdr))
+	return data
+}
+
+func TestConvert_Errors(t *testing.T) {
+	srv := New(Config{MaxBodySize: 1024})
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		body   []byte
+		want   int
+	}{
+		{"wrong method", http.MethodGet, "", nil, http.StatusMethodNotAllowed},
+		{"unknown option", http.MethodPost, "?colour=red", testPNG(t, 4, 4), http.StatusBadRequest},
+		{"invalid quality", http.MethodPost, "?quality=500", testPNG(t, 4, 4), http.StatusBadRequest},
+		{"two targets", http.MethodPost, "?target-size=1KB&target-psnr=40", testPNG(t, 4, 4), http.StatusBadRequest},
+		{"unknown format", http.MethodPost, "?to=gif", testPNG(t, 4, 4), http.StatusBadRequest},
+		{"empty body", http.MethodPost, "", nil, http.StatusBadRequest},
+		{"too large", http.MethodPost, "", make([]byte, 2048), http.StatusRequestEntityTooLarge},
+		{"not an image", http.MethodPost, "", []byte("not an image"), http.StatusUnprocessableEntity},
+		{"too many pixels", http.MethodPost, "", hugePNG(t), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, httptest.NewRequest(tt.method, "/convert"+tt.query, bytes.NewReader(tt.body)))
+			if rec.Code != tt.want {
+				t.Errorf("Status %d, expected %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestConvert_ConcurrencyLimit(t *testing.T) {
+	srv := New(Config{MaxConcurrent: 1})
+	srv.slots <- struct{}{} // Occupy the only slot.
+
+	body := bytes.NewReader(testPNG(t, 4, 4))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/convert", body))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Got status %d, expected 503 with Retry-After", rec.Code)
+	}
+	if body.Len() != int(body.Size()) {
+		t.Error("The body of a rejected request was read")
+	}
+
+	<-srv.slots
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/convert", bytes.NewReader(testPNG(t, 4, 4))))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Got status %d after the slot was freed, expected 200", rec.Code)
+	}
+}
+
+func TestHealthzAndMetrics(t *testing.T) {
+	srv := New(Config{})
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/convert", bytes.NewReader(testPNG(t, 4, 4))))
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/convert", strings.NewReader("junk")))
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "ok" {
+		t.Errorf("/healthz returned %d %q", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := rec.Body.String()
+	for _, want := range []string{
+		`imageconverter_requests_total{code="200"} 1`,
+		`imageconverter_requests_total{code="422"} 1`,
+		"imageconverter_conversions_in_flight 0",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("/metrics is missing %q:\n%s", want, metrics)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package vp8l
+
+// bitWriter packs values into a byte stream least-significant bit first, as
+// required by the VP8L bitstream.
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+// writeBits appends the low n bits of v. n must not exceed 32.
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.bits |= uint64(v&(1<<n-1)) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.nBits -= 8
+	}
+}
+
+// writeBool appends a single bit.
+func (w *bitWriter) writeBool(b bool) {
+	if b {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+// bytes flushes any partial byte, padding it with zero bits, and returns the stream.
+func (w *bitWriter) bytes() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.nBits = 0, 0
+	}
+	return w.buf
+}
@@ -0,0 +1,342 @@
+// Package vp8l implements a pure-Go encoder for lossless WebP (VP8L) images.
+//
+// The encoder applies the subtract-green, predictor and cross-colour
+// transforms, finds LZ77 backward references and entropy codes the result
+// with canonical Huffman codes. It does not use colour caches, meta Huffman
+// codes or the colour-indexing transform, trading some compression for
+// simplicity. The format is specified at
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+package vp8l
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+)
+
+const (
+	// maxDimension is the largest width or height a VP8L image can have.
+	maxDimension = 1 << 14
+	// signature is the first byte of a VP8L bitstream.
+	signature = 0x2f
+
+	// transformBits is the log-2 tile size of the predictor and cross-colour transforms.
+	transformBits = 4
+
+	numLiteralCodes  = 256
+	numLengthCodes   = 24
+	numDistanceCodes = 40
+	// numDistanceMapCodes is the number of short distance codes that map
+	// to two-dimensional offsets.
+	numDistanceMapCodes = 120
+
+	// minMatchLength is the shortest backward reference worth emitting.
+	minMatchLength = 3
+	// maxMatchLength is the longest backward reference the format allows.
+	maxMatchLength = 4096
+	// windowSize is the largest backward reference distance the format allows.
+	windowSize = 1<<20 - numDistanceMapCodes
+	// maxChainLength bounds how many earlier positions are tried per pixel.
+	maxChainLength = 32
+	hashBits       = 18
+)
+
+// distanceMapTable lists the two-dimensional offsets of the short distance
+// codes as (yOffset << 4) | (8 - xOffset), specified in section 4.2.2.
+var distanceMapTable = [numDistanceMapCodes]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// planeCodes is the inverse of distanceMapTable: the 1-based distance code
+// for every (yOffset << 4) | (8 - xOffset), or 0 if there is none.
+var planeCodes = func() (codes [128]uint8) {
+	for i, v := range distanceMapTable {
+		codes[v] = uint8(i + 1)
+	}
+	return codes
+}()
+
+// Options controls encoding.
+type Options struct {
+	// Exact preserves the RGB values of fully transparent pixels. When it is
+	// false those values are cleared, which usually compresses better.
+	Exact bool
+}
+
+// Encode writes img to w as a lossless WebP file with default options.
+func Encode(w io.Writer, img image.Image) error {
+	return EncodeOptions(w, img, Options{})
+}
+
+// EncodeOptions writes img to w as a lossless WebP file.
+func EncodeOptions(w io.Writer, img image.Image, opts Options) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 {
+		return errors.New("vp8l: image is empty")
+	}
+	if width > maxDimension || height > maxDimension {
+		return fmt.Errorf("vp8l: image is %dx%d, dimensions are limited to %d", width, height, maxDimension)
+	}
+
+	argb, hasAlpha := toARGB(img, opts.Exact)
+
+	bw := &bitWriter{}
+	bw.writeBits(signature, 8)
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	bw.writeBool(hasAlpha)
+	bw.writeBits(0, 3) // Version.
+
+	bw.writeBits(1, 1)
+	bw.writeBits(transformSubtractGreen, 2)
+	subtractGreen(argb)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(transformPredictor, 2)
+	bw.writeBits(transformBits-2, 3)
+	modes := applyPredictor(argb, width, height, transformBits)
+	writeImageData(bw, modes, tiles(width, transformBits), false)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(transformCrossColor, 2)
+	bw.writeBits(transformBits-2, 3)
+	multipliers := applyCrossColor(argb, width, height, transformBits)
+	writeImageData(bw, multipliers, tiles(width, transformBits), false)
+
+	bw.writeBits(0, 1) // No more transforms.
+	writeImageData(bw, argb, width, true)
+
+	return writeRIFF(w, bw.bytes())
+}
+
+// toARGB converts img to packed ARGB pixels in row-major order and reports
+// whether any pixel is not fully opaque.
+func toARGB(img image.Image, exact bool) ([]uint32, bool) {
+	bounds := img.Bounds()
+	argb := make([]uint32, 0, bounds.Dx()*bounds.Dy())
+	hasAlpha := false
+	nrgba, isNRGBA := img.(*image.NRGBA)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var c color.NRGBA
+			if isNRGBA {
+				c = nrgba.NRGBAAt(x, y)
+			} else {
+				c = color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			}
+			if c.A != 0xff {
+				hasAlpha = true
+			}
+			if c.A == 0 && !exact {
+				c = color.NRGBA{}
+			}
+			argb = append(argb, uint32(c.A)<<24|uint32(c.R)<<16|uint32(c.G)<<8|uint32(c.B))
+		}
+	}
+	return argb, hasAlpha
+}
+
+// writeRIFF wraps a VP8L bitstream in a WebP RIFF container.
+func writeRIFF(w io.Writer, data []byte) error {
+	padded := len(data) + len(data)&1
+	header := make([]byte, 20)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(4+8+padded))
+	copy(header[8:12], "WEBP")
+	copy(header[12:16], "VP8L")
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if padded != len(data) {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// token is either a literal pixel or a backward reference.
+type token struct {
+	argb     uint32
+	length   int // Zero for literals.
+	distCode int // 1-based distance code for backward references.
+}
+
+// prefixEncode splits a 1-based length or distance code into a prefix
+// symbol and extra bits, the inverse of the decoder's LZ77 parameter
+// decoding in section 4.2.2.
+func prefixEncode(value int) (symbol int, extraBits uint, extra uint32) {
+	d := value - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	highBit := bits.Len(uint(d)) - 1
+	second := (d >> (highBit - 1)) & 1
+	extraBits = uint(highBit - 1)
+	return 2*highBit + second, extraBits, uint32(d) & (1<<extraBits - 1)
+}
+
+// distanceToCode maps a linear backward distance to a distance code,
+// preferring the short two-dimensional codes for nearby pixels.
+func distanceToCode(width, dist int) int {
+	yOffset, xOffset := dist/width, dist%width
+	if xOffset <= 8 && yOffset < 8 {
+		if code := planeCodes[yOffset<<4|(8-xOffset)]; code != 0 {
+			return int(code)
+		}
+	}
+	if xOffset-width >= -7 && yOffset+1 < 8 {
+		if code := planeCodes[(yOffset+1)<<4|(8-(xOffset-width))]; code != 0 {
+			return int(code)
+		}
+	}
+	return dist + numDistanceMapCodes
+}
+
+// hashPair hashes the two pixels starting at i.
+func hashPair(argb []uint32, i int) uint32 {
+	h := uint64(argb[i])*0x1e35a7bd + uint64(argb[i+1])*0x9e3779b1
+	return uint32(h>>16) & (1<<hashBits - 1)
+}
+
+// findMatches greedily turns pixels into literals and backward references
+// using hash chains over pixel pairs.
+func findMatches(argb []uint32, width int) []token {
+	n := len(argb)
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	insert := func(i int) {
+		if i+1 < n {
+			h := hashPair(argb, i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+	matchLength := func(i, dist int) int {
+		limit := min(maxMatchLength, n-i)
+		l := 0
+		for l < limit && argb[i+l] == argb[i+l-dist] {
+			l++
+		}
+		return l
+	}
+
+	tokens := make([]token, 0, n/2)
+	for i := 0; i < n; {
+		bestLength, bestDist := 0, 0
+		if i+minMatchLength <= n {
+			// Repeating the previous pixel or the row above are the most
+			// common matches; try them before walking the hash chain.
+			for _, dist := range [2]int{1, width} {
+				if dist <= i {
+					if l := matchLength(i, dist); l > bestLength {
+						bestLength, bestDist = l, dist
+					}
+				}
+			}
+			candidate := head[hashPair(argb, i)]
+			for chain := 0; candidate >= 0 && chain < maxChainLength && bestLength < maxMatchLength; chain++ {
+				dist := i - int(candidate)
+				if dist > windowSize {
+					break
+				}
+				// A candidate can only be longer if it also matches at the
+				// current best length, which rejects most of them cheaply.
+				if i+bestLength < n && argb[i+bestLength] == argb[i+bestLength-dist] {
+					if l := matchLength(i, dist); l > bestLength {
+						bestLength, bestDist = l, dist
+					}
+				}
+				candidate = prev[candidate]
+			}
+		}
+
+		if bestLength >= minMatchLength {
+			tokens = append(tokens, token{length: bestLength, distCode: distanceToCode(width, bestDist)})
+			for end := i + bestLength; i < end; i++ {
+				insert(i)
+			}
+			continue
+		}
+		tokens = append(tokens, token{argb: argb[i]})
+		insert(i)
+		i++
+	}
+	return tokens
+}
+
+// writeImageData entropy codes an image: the whole ARGB image when topLevel
+// is set, or a transform's sub-image otherwise.
+func writeImageData(bw *bitWriter, argb []uint32, width int, topLevel bool) {
+	tokens := findMatches(argb, width)
+
+	histograms := [5][]uint32{
+		make([]uint32, numLiteralCodes+numLengthCodes),
+		make([]uint32, numLiteralCodes),
+		make([]uint32, numLiteralCodes),
+		make([]uint32, numLiteralCodes),
+		make([]uint32, numDistanceCodes),
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			histograms[0][(t.argb>>8)&0xff]++
+			histograms[1][(t.argb>>16)&0xff]++
+			histograms[2][t.argb&0xff]++
+			histograms[3][t.argb>>24]++
+			continue
+		}
+		lengthSymbol, _, _ := prefixEncode(t.length)
+		distSymbol, _, _ := prefixEncode(t.distCode)
+		histograms[0][numLiteralCodes+lengthSymbol]++
+		histograms[4][distSymbol]++
+	}
+
+	bw.writeBits(0, 1) // No colour cache.
+	if topLevel {
+		bw.writeBits(0, 1) // A single group of Huffman codes for the whole image.
+	}
+	var codes [5]*huffmanCode
+	for i, histogram := range histograms {
+		codes[i] = newHuffmanCode(histogram, maxCodeLength)
+		writeHuffmanCode(bw, codes[i])
+	}
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].write(bw, int((t.argb>>8)&0xff))
+			codes[1].write(bw, int((t.argb>>16)&0xff))
+			codes[2].write(bw, int(t.argb&0xff))
+			codes[3].write(bw, int(t.argb>>24))
+			continue
+		}
+		symbol, extraBits, extra := prefixEncode(t.length)
+		codes[0].write(bw, numLiteralCodes+symbol)
+		bw.writeBits(extra, extraBits)
+		symbol, extraBits, extra = prefixEncode(t.distCode)
+		codes[4].write(bw, symbol)
+		bw.writeBits(extra, extraBits)
+	}
+}
@@ -0,0 +1,161 @@
+package vp8l_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+
+	"imageconverter/internal/vp8l"
+)
+
+// roundTrip encodes img, decodes it with golang.org/x/image/webp and returns
+// the decoded image along with the encoded size.
+func roundTrip(t *testing.T, img image.Image, opts vp8l.Options) (image.Image, int) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := vp8l.EncodeOptions(&buf, img, opts); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to decode encoded image (%d bytes): %v", buf.Len(), err)
+	}
+	return decoded, buf.Len()
+}
+
+// checkIdentical fails the test if got differs from want at any pixel.
+// Fully transparent pixels only need to match in alpha unless exact is set.
+func checkIdentical(t *testing.T, want, got image.Image, exact bool) {
+	t.Helper()
+	if want.Bounds().Size() != got.Bounds().Size() {
+		t.Fatalf("Expected size %v, got %v", want.Bounds().Size(), got.Bounds().Size())
+	}
+	wb, gb := want.Bounds(), got.Bounds()
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			w := color.NRGBAModel.Convert(want.At(wb.Min.X+x, wb.Min.Y+y)).(color.NRGBA)
+			g := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y)).(color.NRGBA)
+			if w.A == 0 && !exact {
+				w, g = color.NRGBA{}, color.NRGBA{A: g.A}
+			}
+			if w != g {
+				t.Fatalf("Pixel (%d, %d): expected %v, got %v", x, y, w, g)
+			}
+		}
+	}
+}
+
+func noiseImage(rng *rand.Rand, width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng.Read(img.Pix)
+	return img
+}
+
+func solidImage(c color.NRGBA, width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func gradientImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 3), G: uint8(y * 5), B: uint8(x + y), A: 255})
+		}
+	}
+	return img
+}
+
+// photoLikeImage builds a smooth image with mild noise and a translucent
+// overlay, exercising every predictor and the cross-colour transform.
+func photoLikeImage(rng *rand.Rand, width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			base := (x*x + y*3) / 7
+			n := rng.Intn(5)
+			a := uint8(255)
+			if x > width/2 && y > height/2 {
+				a = uint8(128 + (x+y)%100)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(base + n), G: uint8(base/2 + n), B: uint8(base/3 + 2*n), A: a})
+		}
+	}
+	return img
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	paletted := image.NewPaletted(image.Rect(0, 0, 33, 9), color.Palette{color.Black, color.White, color.NRGBA{R: 200, A: 128}})
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rng.Intn(3))
+	}
+	transparent := noiseImage(rng, 20, 20)
+	for i := 3; i < len(transparent.Pix); i += 8 {
+		transparent.Pix[i] = 0
+	}
+
+	for name, img := range map[string]image.Image{
+		"1x1":            noiseImage(rng, 1, 1),
+		"single column":  noiseImage(rng, 1, 37),
+		"single row":     noiseImage(rng, 41, 1),
+		"noise":          noiseImage(rng, 67, 45),
+		"gradient":       gradientImage(130, 70),
+		"photo-like":     photoLikeImage(rng, 200, 150),
+		"solid":          solidImage(color.NRGBA{R: 10, G: 20, B: 30, A: 255}, 50, 50),
+		"paletted":       paletted,
+		"gray":           image.NewGray(image.Rect(0, 0, 5, 3)),
+		"transparent":    transparent,
+		"offset bounds":  noiseImage(rng, 30, 30).SubImage(image.Rect(5, 7, 23, 19)),
+		"premultiplied":  image.NewRGBA(image.Rect(0, 0, 16, 16)),
+		"long run width": gradientImage(1000, 3),
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, _ := roundTrip(t, img, vp8l.Options{})
+			checkIdentical(t, img, got, false)
+		})
+	}
+}
+
+func TestEncode_Exact(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	img := noiseImage(rng, 24, 24)
+	for i := 3; i < len(img.Pix); i += 4 {
+		if i%3 == 0 {
+			img.Pix[i] = 0
+		}
+	}
+	got, _ := roundTrip(t, img, vp8l.Options{Exact: true})
+	checkIdentical(t, img, got, true)
+}
+
+func TestEncode_Compresses(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	img := photoLikeImage(rng, 256, 256)
+	got, size := roundTrip(t, img, vp8l.Options{})
+	checkIdentical(t, img, got, false)
+	if raw := len(img.Pix); size > raw/2 {
+		t.Errorf("Expected a smooth image to compress to under half its raw size (%d bytes), got %d bytes", raw, size)
+	}
+
+	flat := gradientImage(512, 512)
+	if _, size := roundTrip(t, flat, vp8l.Options{}); size > len(flat.Pix)/100 {
+		t.Errorf("Expected a gradient to compress to under 1%% of its raw size (%d bytes), got %d bytes", len(flat.Pix), size)
+	}
+}
+
+func TestEncode_RejectsOversizedImages(t *testing.T) {
+	var buf bytes.Buffer
+	if err := vp8l.Encode(&buf, image.NewGray(image.Rect(0, 0, 16385, 1))); err == nil {
+		t.Errorf("Expected an error for an image wider than 16384 pixels")
+	}
+	if err := vp8l.Encode(&buf, image.NewGray(image.Rect(0, 0, 0, 0))); err == nil {
+		t.Errorf("Expected an error for an empty image")
+	}
+}
@@ -0,0 +1,285 @@
+package vp8l
+
+import (
+	"math/bits"
+	"sort"
+)
+
+const (
+	// maxCodeLength is the longest Huffman code allowed for the pixel alphabets.
+	maxCodeLength = 15
+	// maxCodeLengthCodeLength is the longest code allowed for the code-length alphabet.
+	maxCodeLengthCodeLength = 7
+	// numCodeLengthCodes is the size of the code-length alphabet: the lengths
+	// 0 to 15 plus the repeat codes 16, 17 and 18.
+	numCodeLengthCodes = 19
+)
+
+// codeLengthCodeOrder is the order in which code-length code lengths are
+// stored, specified in section 5.2.2.
+var codeLengthCodeOrder = [numCodeLengthCodes]int{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// huffmanCode is a canonical Huffman code ready for writing symbols.
+type huffmanCode struct {
+	// lengths holds the code length of every symbol, zero for unused ones.
+	lengths []uint8
+	// codes holds the bit-reversed code of every symbol, so that it can be
+	// written least-significant bit first.
+	codes []uint16
+	// zeroBits is set when the decoder will read the code without consuming
+	// any bits, which is the case for codes with fewer than two symbols.
+	zeroBits bool
+}
+
+// newHuffmanCode builds a length-limited canonical Huffman code for the
+// symbol frequencies in histogram.
+func newHuffmanCode(histogram []uint32, maxLength int) *huffmanCode {
+	h := &huffmanCode{
+		lengths: huffmanLengths(histogram, maxLength),
+		codes:   make([]uint16, len(histogram)),
+	}
+	used := 0
+	for _, l := range h.lengths {
+		if l != 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		h.zeroBits = true
+		return h
+	}
+
+	// Assign canonical codes, shortest first and in symbol order within a
+	// length, exactly as the decoder reconstructs them.
+	var lengthCount [maxCodeLength + 1]uint16
+	for _, l := range h.lengths {
+		lengthCount[l]++
+	}
+	lengthCount[0] = 0
+	var next [maxCodeLength + 1]uint16
+	code := uint16(0)
+	for l := 1; l <= maxCodeLength; l++ {
+		code = (code + lengthCount[l-1]) << 1
+		next[l] = code
+	}
+	for sym, l := range h.lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		h.codes[sym] = bits.Reverse16(c) >> (16 - l)
+	}
+	return h
+}
+
+// write emits the code for sym.
+func (h *huffmanCode) write(w *bitWriter, sym int) {
+	if h.zeroBits {
+		return
+	}
+	w.writeBits(uint32(h.codes[sym]), uint(h.lengths[sym]))
+}
+
+// huffmanLengths computes Huffman code lengths no longer than maxLength. When
+// the optimal tree is too deep, the smallest counts are raised and the tree
+// is rebuilt until it fits. A lone symbol gets length 1.
+func huffmanLengths(histogram []uint32, maxLength int) []uint8 {
+	lengths := make([]uint8, len(histogram))
+	var symbols []int
+	for sym, count := range histogram {
+		if count != 0 {
+			symbols = append(symbols, sym)
+		}
+	}
+	switch len(symbols) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[symbols[0]] = 1
+		return lengths
+	}
+
+	for countMin := uint32(1); ; countMin *= 2 {
+		if buildLengths(histogram, symbols, countMin, lengths) <= maxLength {
+			return lengths
+		}
+	}
+}
+
+// buildLengths fills lengths with the depths of a Huffman tree over symbols,
+// treating every count below countMin as countMin, and returns the depth of
+// the deepest leaf.
+func buildLengths(histogram []uint32, symbols []int, countMin uint32, lengths []uint8) int {
+	type node struct {
+		count  uint64
+		parent int
+	}
+	n := len(symbols)
+	nodes := make([]node, n, 2*n-1)
+	for i, sym := range symbols {
+		nodes[i] = node{count: uint64(max(histogram[sym], countMin)), parent: -1}
+	}
+	leaves := make([]int, n)
+	for i := range leaves {
+		leaves[i] = i
+	}
+	sort.SliceStable(leaves, func(a, b int) bool { return nodes[leaves[a]].count < nodes[leaves[b]].count })
+
+	// Two-queue construction: leaves in ascending order, and internal nodes,
+	// which are created in ascending order of weight.
+	li, qi := 0, n
+	pick := func() int {
+		if li < n && (qi >= len(nodes) || nodes[leaves[li]].count <= nodes[qi].count) {
+			li++
+			return leaves[li-1]
+		}
+		qi++
+		return qi - 1
+	}
+	for len(nodes) < 2*n-1 {
+		a, b := pick(), pick()
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, parent: -1})
+		nodes[a].parent = len(nodes) - 1
+		nodes[b].parent = len(nodes) - 1
+	}
+
+	// Depths are computed from the root down; parents always come after
+	// their children in nodes.
+	depth := make([]int, len(nodes))
+	maxDepth := 0
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depth[i] = depth[nodes[i].parent] + 1
+	}
+	for i, sym := range symbols {
+		lengths[sym] = uint8(min(depth[i], 255))
+		maxDepth = max(maxDepth, depth[i])
+	}
+	return maxDepth
+}
+
+// writeHuffmanCode writes the code lengths of h, using the simple code
+// format when possible and the normal, code-length-coded format otherwise.
+func writeHuffmanCode(w *bitWriter, h *huffmanCode) {
+	var used []int
+	for sym, l := range h.lengths {
+		if l != 0 {
+			used = append(used, sym)
+			if len(used) > 2 {
+				break
+			}
+		}
+	}
+	if len(used) == 0 {
+		// Nothing is ever coded with this alphabet; declare a single symbol.
+		used = []int{0}
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		writeSimpleCode(w, used)
+		return
+	}
+	writeNormalCode(w, h.lengths)
+}
+
+// writeSimpleCode writes a code of one or two symbols below 256.
+func writeSimpleCode(w *bitWriter, symbols []int) {
+	w.writeBits(1, 1)
+	w.writeBits(uint32(len(symbols)-1), 1)
+	if symbols[0] < 2 {
+		w.writeBits(0, 1)
+		w.writeBits(uint32(symbols[0]), 1)
+	} else {
+		w.writeBits(1, 1)
+		w.writeBits(uint32(symbols[0]), 8)
+	}
+	if len(symbols) == 2 {
+		w.writeBits(uint32(symbols[1]), 8)
+	}
+}
+
+// codeLengthToken is one symbol of the code-length alphabet with its repeat
+// count, which is stored in extra bits for the repeat codes.
+type codeLengthToken struct {
+	code  int
+	extra uint32
+}
+
+// codeLengthExtraBits is the number of extra bits after repeat codes 16, 17 and 18.
+var codeLengthExtraBits = [3]uint{2, 3, 7}
+
+// writeNormalCode writes code lengths run-length encoded with the
+// code-length alphabet, which is itself Huffman coded.
+func writeNormalCode(w *bitWriter, lengths []uint8) {
+	tokens := tokenizeCodeLengths(lengths)
+	histogram := make([]uint32, numCodeLengthCodes)
+	for _, t := range tokens {
+		histogram[t.code]++
+	}
+	clCode := newHuffmanCode(histogram, maxCodeLengthCodeLength)
+
+	numCodes := 4
+	for i := numCodeLengthCodes - 1; i >= 4; i-- {
+		if clCode.lengths[codeLengthCodeOrder[i]] != 0 {
+			numCodes = i + 1
+			break
+		}
+	}
+	w.writeBits(0, 1) // Not a simple code.
+	w.writeBits(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		w.writeBits(uint32(clCode.lengths[codeLengthCodeOrder[i]]), 3)
+	}
+	w.writeBits(0, 1) // Code lengths are given for the whole alphabet.
+
+	for _, t := range tokens {
+		clCode.write(w, t.code)
+		if t.code >= 16 {
+			w.writeBits(t.extra, codeLengthExtraBits[t.code-16])
+		}
+	}
+}
+
+// tokenizeCodeLengths run-length encodes lengths: code 16 repeats the
+// previous non-zero length 3 to 6 times, code 17 writes 3 to 10 zeros and
+// code 18 writes 11 to 138 zeros.
+func tokenizeCodeLengths(lengths []uint8) []codeLengthToken {
+	var tokens []codeLengthToken
+	for i := 0; i < len(lengths); {
+		value := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == value {
+			run++
+		}
+		i += run
+
+		if value == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				tokens = append(tokens, codeLengthToken{code: 18, extra: uint32(n - 11)})
+				run -= n
+			}
+			if run >= 3 {
+				tokens = append(tokens, codeLengthToken{code: 17, extra: uint32(run - 3)})
+				run = 0
+			}
+			for ; run > 0; run-- {
+				tokens = append(tokens, codeLengthToken{code: 0})
+			}
+			continue
+		}
+
+		tokens = append(tokens, codeLengthToken{code: int(value)})
+		run--
+		for run >= 3 {
+			n := min(run, 6)
+			tokens = append(tokens, codeLengthToken{code: 16, extra: uint32(n - 3)})
+			run -= n
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, codeLengthToken{code: int(value)})
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,291 @@
+package vp8l
+
+// This file implements the forward transforms, specified in section 4. The
+// decoder undoes them in the reverse order of their appearance in the
+// bitstream.
+
+const (
+	transformPredictor     = 0
+	transformCrossColor    = 1
+	transformSubtractGreen = 2
+)
+
+// numPredictorModes is the number of predictor modes defined by the format.
+const numPredictorModes = 14
+
+// tiles returns the number of tiles needed to cover size pixels with tiles
+// that are 1<<bits pixels wide.
+func tiles(size, bits int) int {
+	return (size + 1<<bits - 1) >> bits
+}
+
+// subtractGreen subtracts the green channel from red and blue.
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		green := (p >> 8) & 0xff
+		r := ((p >> 16) - green) & 0xff
+		b := (p - green) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// channel returns the 8-bit channel of p starting at bit shift.
+func channel(p uint32, shift uint) int32 {
+	return int32((p >> shift) & 0xff)
+}
+
+// average2 averages two pixels channel by channel, rounding down.
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// clampByte clamps v to the range of a byte.
+func clampByte(v int32) uint32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint32(v)
+}
+
+// clampAddSubtractFull returns a + b - c per channel, clamped.
+func clampAddSubtractFull(a, b, c uint32) uint32 {
+	var out uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		out |= clampByte(channel(a, shift)+channel(b, shift)-channel(c, shift)) << shift
+	}
+	return out
+}
+
+// clampAddSubtractHalf returns a + (a - b) / 2 per channel, clamped.
+func clampAddSubtractHalf(a, b uint32) uint32 {
+	var out uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		ca := channel(a, shift)
+		out |= clampByte(ca+(ca-channel(b, shift))/2) << shift
+	}
+	return out
+}
+
+// absInt32 returns the absolute value of v.
+func absInt32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// selectPredictor returns whichever of left and top is closer to the
+// gradient estimate left + top - topLeft.
+func selectPredictor(left, top, topLeft uint32) uint32 {
+	var pLeft, pTop int32
+	for shift := uint(0); shift < 32; shift += 8 {
+		pLeft += absInt32(channel(top, shift) - channel(topLeft, shift))
+		pTop += absInt32(channel(left, shift) - channel(topLeft, shift))
+	}
+	if pLeft < pTop {
+		return left
+	}
+	return top
+}
+
+// predict returns the prediction for the pixel at index i of an image of the
+// given width using mode. It must only be called for pixels that have both a
+// top and a left neighbour. The top-right neighbour of the last pixel in a row
+// is the first pixel of the current row, as in the decoder.
+func predict(argb []uint32, i, width, mode int) uint32 {
+	left := argb[i-1]
+	top := argb[i-width]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return left
+	case 2:
+		return top
+	case 3:
+		return argb[i-width+1]
+	case 4:
+		return argb[i-width-1]
+	case 5:
+		return average2(average2(left, argb[i-width+1]), top)
+	case 6:
+		return average2(left, argb[i-width-1])
+	case 7:
+		return average2(left, top)
+	case 8:
+		return average2(argb[i-width-1], top)
+	case 9:
+		return average2(top, argb[i-width+1])
+	case 10:
+		return average2(average2(left, argb[i-width-1]), average2(top, argb[i-width+1]))
+	case 11:
+		return selectPredictor(left, top, argb[i-width-1])
+	case 12:
+		return clampAddSubtractFull(left, top, argb[i-width-1])
+	default:
+		return clampAddSubtractHalf(average2(left, top), argb[i-width-1])
+	}
+}
+
+// subPixels subtracts b from a channel by channel, modulo 256.
+func subPixels(a, b uint32) uint32 {
+	alphaGreen := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	redBlue := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return alphaGreen&0xff00ff00 | redBlue&0x00ff00ff
+}
+
+// residualCost estimates how expensive a residual is to entropy code.
+func residualCost(r uint32) int32 {
+	var cost int32
+	for shift := uint(0); shift < 32; shift += 8 {
+		cost += absInt32(int32(int8(r >> shift)))
+	}
+	return cost
+}
+
+// applyPredictor replaces argb with prediction residuals. For every tile it
+// picks the predictor mode with the smallest residuals and returns the mode
+// image, one pixel per tile with the mode stored in the green channel.
+func applyPredictor(argb []uint32, width, height, bits int) []uint32 {
+	tilesX, tilesY := tiles(width, bits), tiles(height, bits)
+	modes := make([]uint32, tilesX*tilesY)
+	residuals := make([]uint32, len(argb))
+
+	// The first row and column use fixed predictors.
+	residuals[0] = subPixels(argb[0], 0xff000000)
+	for x := 1; x < width; x++ {
+		residuals[x] = subPixels(argb[x], argb[x-1])
+	}
+	for y := 1; y < height; y++ {
+		residuals[y*width] = subPixels(argb[y*width], argb[(y-1)*width])
+	}
+
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			x0, y0 := max(tx<<bits, 1), max(ty<<bits, 1)
+			x1, y1 := min((tx+1)<<bits, width), min((ty+1)<<bits, height)
+
+			bestMode, bestCost := 0, int32(-1)
+			for mode := 0; mode < numPredictorModes; mode++ {
+				var cost int32
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						i := y*width + x
+						cost += residualCost(subPixels(argb[i], predict(argb, i, width, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					i := y*width + x
+					residuals[i] = subPixels(argb[i], predict(argb, i, width, bestMode))
+				}
+			}
+			modes[ty*tilesX+tx] = 0xff000000 | uint32(bestMode)<<8
+		}
+	}
+	copy(argb, residuals)
+	return modes
+}
+
+// colorTransformDelta is the cross-colour term of section 4.2.
+func colorTransformDelta(t, c int8) int32 {
+	return (int32(t) * int32(c)) >> 5
+}
+
+// crossColor holds the multipliers of one cross-colour tile.
+type crossColor struct {
+	greenToRed, greenToBlue, redToBlue int8
+}
+
+// apply transforms one pixel; the decoder adds the same deltas back.
+func (m crossColor) apply(p uint32) uint32 {
+	green := int8(p >> 8)
+	red := int8(p >> 16)
+	newRed := int32(red) - colorTransformDelta(m.greenToRed, green)
+	newBlue := int32(int8(p)) - colorTransformDelta(m.greenToBlue, green) - colorTransformDelta(m.redToBlue, red)
+	return p&0xff00ff00 | uint32(newRed&0xff)<<16 | uint32(newBlue&0xff)
+}
+
+// bestMultiplier finds the multiplier t minimising the magnitude of
+// target - (t * source) >> 5 over the given samples. A least-squares estimate
+// is refined by trying its neighbours, and zero is always considered.
+func bestMultiplier(source, target []int8) int8 {
+	var sumST, sumSS int64
+	for i := range source {
+		sumST += int64(source[i]) * int64(target[i])
+		sumSS += int64(source[i]) * int64(source[i])
+	}
+	estimate := 0
+	if sumSS != 0 {
+		estimate = int(32 * sumST / sumSS)
+	}
+	estimate = max(-128, min(127, estimate))
+
+	cost := func(t int) int32 {
+		var c int32
+		for i := range source {
+			c += absInt32(int32(int8(int32(target[i]) - colorTransformDelta(int8(t), source[i]))))
+		}
+		return c
+	}
+	best, bestCost := 0, cost(0)
+	for t := max(-128, estimate-2); t <= min(127, estimate+2); t++ {
+		if c := cost(t); c < bestCost {
+			best, bestCost = t, c
+		}
+	}
+	return int8(best)
+}
+
+// applyCrossColor decorrelates red and blue from green (and blue from red)
+// tile by tile and returns the multiplier image.
+func applyCrossColor(argb []uint32, width, height, bits int) []uint32 {
+	tilesX, tilesY := tiles(width, bits), tiles(height, bits)
+	multipliers := make([]uint32, tilesX*tilesY)
+	var reds, greens, blues, partialBlues []int8
+
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			x0, y0 := tx<<bits, ty<<bits
+			x1, y1 := min((tx+1)<<bits, width), min((ty+1)<<bits, height)
+
+			reds, greens, blues = reds[:0], greens[:0], blues[:0]
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					p := argb[y*width+x]
+					reds = append(reds, int8(p>>16))
+					greens = append(greens, int8(p>>8))
+					blues = append(blues, int8(p))
+				}
+			}
+
+			var m crossColor
+			m.greenToRed = bestMultiplier(greens, reds)
+			m.greenToBlue = bestMultiplier(greens, blues)
+			partialBlues = partialBlues[:0]
+			for i := range blues {
+				partialBlues = append(partialBlues, int8(int32(blues[i])-colorTransformDelta(m.greenToBlue, greens[i])))
+			}
+			m.redToBlue = bestMultiplier(reds, partialBlues)
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					argb[y*width+x] = m.apply(argb[y*width+x])
+				}
+			}
+			multipliers[ty*tilesX+tx] = 0xff000000 |
+				uint32(uint8(m.redToBlue))<<16 |
+				uint32(uint8(m.greenToBlue))<<8 |
+				uint32(uint8(m.greenToRed))
+		}
+	}
+	return multipliers
+}
@@ -0,0 +1,259 @@
+// Package watcher reports files in a directory tree that are created or
+// modified, once their writes have settled.
+//
+// Changes are detected with file system notifications (inotify, kqueue,
+// ReadDirectoryChangesW) through fsnotify, falling back to periodically
+// scanning the tree when notifications are unavailable, e.g. on network
+// file systems or when the inotify watch limit is exhausted.
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Default timings used when the corresponding Options fields are zero.
+const (
+	DefaultDebounce     = 2 * time.Second
+	DefaultPollInterval = 5 * time.Second
+)
+
+// Options controls a Watcher.
+type Options struct {
+	// Debounce is how long a file must go without changes before it is
+	// reported, so that files still being written are not picked up.
+	Debounce time.Duration
+	// PollInterval is how often the tree is scanned when polling.
+	PollInterval time.Duration
+	// Poll forces polling even when notifications are available.
+	Poll bool
+	// Ignore, if set, is called for every changed path; changes to paths
+	// for which it returns true are not reported.
+	Ignore func(path string) bool
+}
+
+// fileState is what polling and debouncing compare to detect changes.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// pendingFile is a changed file waiting for its writes to settle.
+type pendingFile struct {
+	state   fileState
+	changed time.Time // When a change was last seen.
+}
+
+// Watcher watches a directory tree for new and modified files.
+type Watcher struct {
+	root    string
+	opts    Options
+	notify  *fsnotify.Watcher // Nil when polling.
+	mu      sync.Mutex
+	pending map[string]pendingFile
+}
+
+// New starts watching the directory tree at root. It uses file system
+// notifications unless opts.Poll is set or they cannot be set up.
+func New(root string, opts Options) (*Watcher, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = DefaultDebounce
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	w := &Watcher{root: root, opts: opts, pending: make(map[string]pendingFile)}
+	if !opts.Poll {
+		if notify, err := fsnotify.NewWatcher(); err == nil {
+			w.notify = notify
+			if err := w.addTree(root); err != nil {
+				notify.Close()
+				w.notify = nil
+			}
+		}
+	}
+	return w, nil
+}
+
+// Polling reports whether the watcher fell back to, or was asked to use, polling.
+func (w *Watcher) Polling() bool {
+	return w.notify == nil
+}
+
+// Run reports settled files to handle until ctx is cancelled. handle is
+// called from a single goroutine, one file at a time.
+func (w *Watcher) Run(ctx context.Context, handle func(path string)) error {
+	if w.notify != nil {
+		defer w.notify.Close()
+	}
+
+	// Files already present are the baseline for polling; they are not reported.
+	snapshot := w.scan()
+	poll := time.NewTicker(w.opts.PollInterval)
+	defer poll.Stop()
+	// Pending files are checked a few times per debounce period, but no more
+	// than once a millisecond: a debounce under 4ns would otherwise give
+	// NewTicker a zero interval, which it rejects with a panic.
+	settle := time.NewTicker(max(min(w.opts.Debounce/4, 250*time.Millisecond), time.Millisecond))
+	defer settle.Stop()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if w.notify != nil {
+		events, errs = w.notify.Events, w.notify.Errors
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			w.handleEvent(event)
+		case err, ok := <-errs:
+			if !ok {
+				return nil
+			}
+			// An overflow means events were lost; a scan finds what they described.
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				snapshot = w.pollChanges(snapshot)
+			}
+		case <-poll.C:
+			if w.notify == nil {
+				snapshot = w.pollChanges(snapshot)
+			}
+		case now := <-settle.C:
+			for _, path := range w.settled(now) {
+				handle(path)
+			}
+		}
+	}
+}
+
+// handleEvent records a file system notification.
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return
+	}
+	info, err := os.Stat(event.Name)
+	if err != nil {
+		return // Removed again already.
+	}
+	if info.IsDir() {
+		// Watch new directories and pick up files created in them before the
+		// watch was added.
+		if event.Has(fsnotify.Create) {
+			w.addTree(event.Name)
+			filepath.WalkDir(event.Name, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && d.Type().IsRegular() {
+					w.touch(path)
+				}
+				return nil
+			})
+		}
+		return
+	}
+	if info.Mode().IsRegular() {
+		w.touch(event.Name)
+	}
+}
+
+// addTree adds notification watches for dir and every directory below it.
+func (w *Watcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		return w.notify.Add(path)
+	})
+}
+
+// scan returns the state of every regular file under the root.
+func (w *Watcher) scan() map[string]fileState {
+	states := make(map[string]fileState)
+	filepath.WalkDir(w.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			states[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+		}
+		return nil
+	})
+	return states
+}
+
+// pollChanges scans the tree, marks files that are new or differ from
+// snapshot as changed, and returns the new snapshot.
+func (w *Watcher) pollChanges(snapshot map[string]fileState) map[string]fileState {
+	current := w.scan()
+	for path, state := range current {
+		if previous, ok := snapshot[path]; !ok || previous != state {
+			w.touch(path)
+		}
+	}
+	return current
+}
+
+// touch marks path as changed now.
+func (w *Watcher) touch(path string) {
+	if w.opts.Ignore != nil && w.opts.Ignore(path) {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[path] = pendingFile{state: stat(path), changed: time.Now()}
+}
+
+// settled returns the pending files that have not changed for the debounce
+// period and stops tracking them. A file whose size or modification time
+// moved since it was last seen is considered still being written.
+func (w *Watcher) settled(now time.Time) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var ready []string
+	for path, p := range w.pending {
+		current := stat(path)
+		if current == (fileState{}) {
+			delete(w.pending, path) // Removed before it settled.
+			continue
+		}
+		if current != p.state {
+			w.pending[path] = pendingFile{state: current, changed: now}
+			continue
+		}
+		if now.Sub(p.changed) >= w.opts.Debounce {
+			ready = append(ready, path)
+			delete(w.pending, path)
+		}
+	}
+	sort.Strings(ready)
+	return ready
+}
+
+// stat returns the state of the file at path, or the zero state if it
+// cannot be read.
+func stat(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{size: info.Size(), modTime: info.ModTime()}
+}
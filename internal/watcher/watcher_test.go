@@ -0,0 +1,120 @@
+package watcher_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imageconverter/internal/watcher"
+)
+
+// collect runs w until it has reported want paths or the timeout expires,
+// writing files with write once the watcher is running.
+func collect(t *testing.T, w *watcher.Watcher, want int, write func()) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reported := make(chan string, 16)
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx, func(path string) { reported <- path })
+	}()
+
+	time.Sleep(100 * time.Millisecond) // Let Run take its baseline snapshot.
+	write()
+
+	var paths []string
+	for len(paths) < want {
+		select {
+		case path := <-reported:
+			paths = append(paths, path)
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for %d reports, got %v", want, paths)
+		}
+	}
+	// Give any unexpected extra reports a chance to arrive.
+	select {
+	case path := <-reported:
+		paths = append(paths, path)
+	case <-time.After(300 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run returned an error: %v", err)
+	}
+	return paths
+}
+
+func TestWatcher_ReportsSettledFiles(t *testing.T) {
+	for _, poll := range []bool{false, true} {
+		name := "notify"
+		if poll {
+			name = "poll"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "existing.png"), []byte("old"), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			w, err := watcher.New(dir, watcher.Options{
+				Debounce:     150 * time.Millisecond,
+				PollInterval: 50 * time.Millisecond,
+				Poll:         poll,
+				Ignore:       func(path string) bool { return strings.HasSuffix(path, ".webp") },
+			})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			if w.Polling() != poll {
+				t.Fatalf("Expected Polling() = %t", poll)
+			}
+
+			newFile := filepath.Join(dir, "sub", "new.png")
+			paths := collect(t, w, 1, func() {
+				if err := os.MkdirAll(filepath.Dir(newFile), 0755); err != nil {
+					t.Fatalf("Failed to create dir: %v", err)
+				}
+				// Write in two parts, as a slow copy would; only one report is expected.
+				f, err := os.Create(newFile)
+				if err != nil {
+					t.Fatalf("Failed to create file: %v", err)
+				}
+				f.Write([]byte("part one"))
+				time.Sleep(60 * time.Millisecond)
+				f.Write([]byte("part two"))
+				f.Close()
+				if err := os.WriteFile(filepath.Join(dir, "output.webp"), []byte("ignored"), 0644); err != nil {
+					t.Fatalf("Failed to write file: %v", err)
+				}
+			})
+			if len(paths) != 1 || paths[0] != newFile {
+				t.Errorf("Expected only %s to be reported, got %v", newFile, paths)
+			}
+		})
+	}
+}
+
+func TestNew_RequiresDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file.png")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := watcher.New(file, watcher.Options{}); err == nil {
+		t.Errorf("Expected an error when watching a file")
+	}
+}
+
+func TestWatcher_TinyDebounce(t *testing.T) {
+	dir := t.TempDir()
+	w, err := watcher.New(dir, watcher.Options{Debounce: 3 * time.Nanosecond, Poll: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	paths := collect(t, w, 0, func() {})
+	if len(paths) != 0 {
+		t.Errorf("Expected no reports, got %v", paths)
+	}
+}